@@ -3,9 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/gorilla/websocket"
@@ -15,6 +19,13 @@ import (
 type Network struct {
 	conn *websocket.Conn
 	send chan []byte
+
+	// The websocket allows one writer at a time
+	writeMu sync.Mutex
+
+	// REST API credential from the server's session event
+	token   string
+	tokenMu sync.RWMutex
 }
 
 func NewNetwork() *Network {
@@ -23,7 +34,10 @@ func NewNetwork() *Network {
 	}
 }
 
-func (n *Network) Connect(host string) error {
+// Connect dials the server's websocket. A saved session token, if given,
+// is sent along so the server can resume that login, and rooms and active
+// ask to be put back in those rooms, with active on screen, once logged in.
+func (n *Network) Connect(host, token string, rooms []string, active string) error {
 	if n.conn != nil {
 		n.conn.Close()
 	}
@@ -56,14 +70,53 @@ func (n *Network) Connect(host string) error {
 		u.Path = "/ws"
 	}
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if len(rooms) > 0 || active != "" {
+		query := u.Query()
+		if len(rooms) > 0 {
+			query.Set("rooms", strings.Join(rooms, ","))
+		}
+		if active != "" {
+			query.Set("room", active)
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		return err
+	}
+
+	hello, err := model.EncodeEvent(model.EventHello, model.HelloPayload{ProtocolVersion: model.ProtocolVersion})
 	if err != nil {
+		c.Close()
+		return err
+	}
+	if err := c.WriteMessage(websocket.TextMessage, hello); err != nil {
+		c.Close()
 		return err
 	}
 	n.conn = c
 	return nil
 }
 
+// SetToken stores the session token used for REST requests.
+func (n *Network) SetToken(token string) {
+	n.tokenMu.Lock()
+	defer n.tokenMu.Unlock()
+	n.token = token
+}
+
+func (n *Network) Token() string {
+	n.tokenMu.RLock()
+	defer n.tokenMu.RUnlock()
+	return n.token
+}
+
 func (n *Network) Disconnect() {
 	if n.conn != nil {
 		n.conn.Close()
@@ -88,11 +141,15 @@ func (n *Network) WaitForMessage() tea.Msg {
 		return nil
 	}
 
-	_, message, err := n.conn.ReadMessage()
+	conn := n.conn
+	_, message, err := conn.ReadMessage()
 	if err != nil {
-		// If error, we might be disconnected
+		if n.conn != conn {
+			// Closed on purpose by Disconnect or a new Connect
+			return disconnectedMsg{err: err, manual: true}
+		}
 		n.Disconnect()
-		return errMsg(err)
+		return disconnectedMsg{err: err}
 	}
 
 	var event model.Event
@@ -103,32 +160,85 @@ func (n *Network) WaitForMessage() tea.Msg {
 	return event
 }
 
-func (n *Network) SendMessage(content string) tea.Cmd {
+// SendMessage sends a chat line or command typed while room was on screen.
+func (n *Network) SendMessage(content, room string) tea.Cmd {
 	return func() tea.Msg {
-		if n.conn == nil {
-			return errMsg(fmt.Errorf("not connected"))
-		}
-
-		event := model.Event{
-			Type:    model.EventMessage,
-			Payload: content,
-		}
-
-		bytes, err := json.Marshal(event)
-		if err != nil {
+		if err := n.writeEvent(model.EventMessage, model.SendPayload{Content: content, Room: room}); err != nil {
 			return errMsg(err)
 		}
+		return nil
+	}
+}
 
-		if err := n.conn.WriteMessage(websocket.TextMessage, bytes); err != nil {
-			return errMsg(err)
+// SendTyping tells the server whether we are typing, to room or to
+// recipient when writing a direct message. Failures are ignored.
+func (n *Network) SendTyping(typing bool, room, recipient string) tea.Cmd {
+	return func() tea.Msg {
+		payload := model.TypingPayload{Typing: typing, Room: room}
+		if recipient != "" {
+			payload = model.TypingPayload{Typing: typing, Recipient: recipient}
 		}
+		n.writeEvent(model.EventTyping, payload)
 		return nil
 	}
 }
 
+// SendMarkRead tells the server we have read room up to messageID.
+// Failures are ignored.
+func (n *Network) SendMarkRead(room, messageID string) tea.Cmd {
+	return func() tea.Msg {
+		n.writeEvent(model.EventMarkRead, model.ReadPayload{Room: room, MessageID: messageID})
+		return nil
+	}
+}
+
+func (n *Network) writeEvent(t model.EventType, payload interface{}) error {
+	conn := n.conn
+	if conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	bytes, err := model.EncodeEvent(t, payload)
+	if err != nil {
+		return err
+	}
+
+	n.writeMu.Lock()
+	defer n.writeMu.Unlock()
+	return conn.WriteMessage(websocket.TextMessage, bytes)
+}
+
 type errMsg error
 
-func (n *Network) FetchMessages(host, room string) ([]model.Message, error) {
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = 30 * time.Second
+)
+
+// reconnectDelay is the exponential backoff before the given attempt,
+// with jitter so clients don't all come back at once after a restart.
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 5 {
+		delay = reconnectBaseDelay << attempt
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func scheduleReconnect(gen, attempt int) tea.Cmd {
+	return tea.Tick(reconnectDelay(attempt), func(time.Time) tea.Msg {
+		return reconnectMsg{gen: gen, attempt: attempt}
+	})
+}
+
+// disconnectedMsg reports that the websocket read loop ended.
+type disconnectedMsg struct {
+	err    error
+	manual bool // The user disconnected or switched servers
+}
+
+// apiBase turns the host given to /connect into the HTTP base URL of the
+// server's REST API.
+func apiBase(host string) string {
 	// Handle URL schemes
 	if !strings.Contains(host, "://") {
 		host = "http://" + host
@@ -144,15 +254,56 @@ func (n *Network) FetchMessages(host, room string) ([]model.Message, error) {
 		host = host + ":8999"
 	}
 
-	// Construct API URL
 	// Remove /ws if present
 	host = strings.Replace(host, "/ws", "", 1)
 	// Ensure no trailing slash
-	host = strings.TrimSuffix(host, "/")
+	return strings.TrimSuffix(host, "/")
+}
 
-	apiURL := host + "/api/messages?room=" + url.QueryEscape(room)
+// historyTarget is the conversation a history request is for: a room, or
+// the direct messages with Peer when Peer is set.
+type historyTarget struct {
+	Room string
+	Peer string
+}
 
-	resp, err := http.Get(apiURL)
+// FetchMessages loads one page of history. With no cursor it returns the
+// latest page. With before set it returns the page of messages older than
+// that message ID, and with after set the messages following it.
+func (n *Network) FetchMessages(host string, target historyTarget, before, after string, limit int) ([]model.Message, error) {
+	endpoint := "/api/messages?"
+	query := url.Values{}
+	if target.Peer != "" {
+		endpoint = "/api/dm?"
+		query.Set("with", target.Peer)
+	} else {
+		query.Set("room", target.Room)
+	}
+	query.Set("limit", strconv.Itoa(limit))
+	if before != "" {
+		query.Set("before", before)
+	}
+	if after != "" {
+		query.Set("after", after)
+	}
+	return n.getMessages(apiBase(host) + endpoint + query.Encode())
+}
+
+// FetchThread loads the whole thread the message with the given ID (or ID
+// prefix) belongs to.
+func (n *Network) FetchThread(host, id string) ([]model.Message, error) {
+	return n.getMessages(apiBase(host) + "/api/thread?" + url.Values{"id": {id}}.Encode())
+}
+
+// getMessages calls a REST endpoint that returns a list of messages.
+func (n *Network) getMessages(apiURL string) ([]model.Message, error) {
+	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+n.Token())
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -169,3 +320,20 @@ func (n *Network) FetchMessages(host, room string) ([]model.Message, error) {
 
 	return messages, nil
 }
+
+// FetchMessagesSince loads every message after the message with the given
+// ID, a page at a time.
+func (n *Network) FetchMessagesSince(host string, target historyTarget, after string, pageSize int) ([]model.Message, error) {
+	var all []model.Message
+	for {
+		page, err := n.FetchMessages(host, target, "", after, pageSize)
+		if err != nil {
+			return all, err
+		}
+		all = append(all, page...)
+		if len(page) < pageSize {
+			return all, nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// savedSession is a session token remembered for one server.
+type savedSession struct {
+	Token    string    `json:"token"`
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+}
+
+// sessionFile is where tokens are kept between runs, e.g.
+// ~/.config/cmppchat/sessions.json on Linux.
+func sessionFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cmppchat", "sessions.json"), nil
+}
+
+func loadSavedSessions() map[string]savedSession {
+	sessions := make(map[string]savedSession)
+	path, err := sessionFile()
+	if err != nil {
+		return sessions
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return sessions
+	}
+	json.Unmarshal(data, &sessions)
+	return sessions
+}
+
+func writeSavedSessions(sessions map[string]savedSession) error {
+	path, err := sessionFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// savedToken returns the unexpired token saved for host, if any.
+func savedToken(host string) string {
+	sess, ok := loadSavedSessions()[apiBase(host)]
+	if !ok || time.Now().After(sess.Expires) {
+		return ""
+	}
+	return sess.Token
+}
+
+func saveSession(host string, sess savedSession) error {
+	sessions := loadSavedSessions()
+	sessions[apiBase(host)] = sess
+	return writeSavedSessions(sessions)
+}
+
+func forgetSession(host string) error {
+	sessions := loadSavedSessions()
+	if _, ok := sessions[apiBase(host)]; !ok {
+		return nil
+	}
+	delete(sessions, apiBase(host))
+	return writeSavedSessions(sessions)
+}
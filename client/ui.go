@@ -1,11 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
@@ -20,22 +24,107 @@ type connectionMsg struct {
 }
 
 type historyFetchMsg struct {
-	host string
-	room string
+	host   string
+	target historyTarget
+	before string // Fetch the page older than this message ID
+	after  string // Fetch everything newer than this message ID
 }
 
 type historyLoadedMsg struct {
+	target   historyTarget
 	messages []model.Message
+	older    bool // An older page, prepended while scrolling up
+	backfill bool // Messages missed while disconnected
+	// The read loop is already running: the first page after /dm switched
+	// views, or a room not on screen catching up after reconnecting
+	background bool
+	err        error
+}
+
+// threadLoadedMsg carries the result of /thread. The read loop keeps
+// running while it loads.
+type threadLoadedMsg struct {
+	id       string
+	messages []model.Message
+	err      error
+}
+
+// typingExpireMsg prompts dropping typists we stopped hearing from.
+type typingExpireMsg struct{}
+
+// reconnectMsg fires when it is time for the next reconnect attempt.
+type reconnectMsg struct {
+	gen     int
+	attempt int
+}
+
+type reconnectResultMsg struct {
+	gen     int
+	attempt int
+	token   string // Token presented to resume the session
+	err     error
+}
+
+// historyPageSize is how many messages are fetched per history request.
+const historyPageSize = 50
+
+const (
+	// typingThrottle is the least time between typing events we send.
+	typingThrottle = 3 * time.Second
+	// typingTimeout is how long someone is shown typing after their last
+	// typing event. It is longer than typingThrottle so it doesn't flicker.
+	typingTimeout = 6 * time.Second
+)
+
+// chatLine is one entry in the viewport: a chat message together with its
+// rendered form, or a local notice with only text.
+type chatLine struct {
+	msg  model.Message
+	text string
+}
+
+// roomBuffer is the scrollback of one conversation: a room we are in, or
+// the direct messages on screen. Rooms keep their buffer while another one
+// is shown, so switching back needs no history fetch.
+type roomBuffer struct {
+	lines []chatLine
+	// IDs of messages already shown, so history and live events don't overlap
+	seenIDs  map[string]bool
+	hasOlder bool
+	loaded   bool // The first page of history arrived
+	// While catching up after a reconnect, live messages wait here so they
+	// land after the ones that were missed
+	stale bool
+	held  []model.Message
+	// Room details, and presence: users in the room and who is typing there
+	topic    string
+	archived bool // The room is read-only
+	members  int
+	typers   map[string]time.Time // Username -> when to stop showing them
+	// Scroll position while another buffer is on screen
+	yOffset  int
+	atBottom bool
+}
+
+func newRoomBuffer() *roomBuffer {
+	return &roomBuffer{
+		seenIDs:  make(map[string]bool),
+		typers:   make(map[string]time.Time),
+		atBottom: true,
+	}
 }
 
 type modelState struct {
 	network   *Network
 	viewport  viewport.Model
 	textInput textinput.Model
-	messages  []string
+	buf       *roomBuffer            // The conversation on screen
+	rooms     map[string]*roomBuffer // Buffers of the rooms we are in
 	err       error
 	ready     bool
 	loading   bool // Loading history
+	// Older history paging
+	fetchingOlder bool
 	// Command History
 	cmdHistory []string
 	historyIdx int
@@ -43,6 +132,19 @@ type modelState struct {
 	Host        string
 	ServerName  string
 	currentRoom string
+	dmPeer      string // When set, the view shows direct messages with this user
+	username    string // Who we are logged in as
+	// Automatic reconnect. connGen changes whenever the user connects or
+	// disconnects by hand, so stale reconnect attempts are dropped.
+	connGen          int
+	reconnecting     bool
+	reconnectAttempt int
+	backfillPending  bool
+	// Whether we last told the server we are typing
+	isTyping   bool
+	typingSent time.Time
+	// Unread counts and read positions of the rooms we can read
+	unread map[string]model.RoomUnread
 }
 
 func initialModel(net *Network) modelState {
@@ -52,14 +154,17 @@ func initialModel(net *Network) modelState {
 	ti.CharLimit = 256
 	ti.Width = 20
 
+	general := newRoomBuffer()
 	return modelState{
 		network:     net,
 		textInput:   ti,
-		messages:    []string{},
+		buf:         general,
+		rooms:       map[string]*roomBuffer{"general": general},
 		cmdHistory:  []string{},
 		historyIdx:  -1,
 		currentRoom: "general",
 		ServerName:  "CMPPChat", // Default
+		unread:      make(map[string]model.RoomUnread),
 	}
 }
 
@@ -87,6 +192,14 @@ func (m modelState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.MouseMsg:
 		m.viewport, vpCmd = m.viewport.Update(msg)
+		// Scrolled to the top: load the previous page of history
+		if m.viewport.AtTop() && m.buf.hasOlder && !m.fetchingOlder {
+			if oldest := m.buf.oldestMessageID(); oldest != "" {
+				m.fetchingOlder = true
+				fetch := historyFetchMsg{host: m.Host, target: m.target(), before: oldest}
+				return m, tea.Batch(vpCmd, func() tea.Msg { return fetch })
+			}
+		}
 		return m, vpCmd
 
 	case tea.KeyMsg:
@@ -100,6 +213,16 @@ func (m modelState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 		switch msg.Type {
+		case tea.KeyCtrlLeft, tea.KeyCtrlRight:
+			// Cycle through the rooms we are in
+			step := 1
+			if msg.Type == tea.KeyCtrlLeft {
+				step = -1
+			}
+			if room := m.nextRoom(step); room != "" {
+				return m, m.showRoom(room)
+			}
+
 		case tea.KeyUp:
 			// History: Newest -> Oldest
 			// cmdHistory: [oldest, ..., newest]
@@ -146,6 +269,7 @@ func (m modelState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					"/login ", "/register ", "/connect ", "/logout", "/help",
 					"/admin ", "/clan ", "/kick ", "/ban ", "/disconnect",
 					"/room ", "/member ", "/userinfo ", "/server ",
+					"/msg ", "/dm ", "/session ", "/edit ", "/delete ", "/reply ", "/thread ", "/react ", "/mentions", "/away",
 				}
 
 				var matches []string
@@ -175,10 +299,12 @@ func (m modelState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if m.textInput.Value() != "" {
 				content := m.textInput.Value()
 				m.textInput.SetValue("")
+				// Sending the message tells the others we stopped typing
+				m.isTyping = false
 
 				// Add to history
-				// Avoid duplicates at the end
-				if len(m.cmdHistory) == 0 || m.cmdHistory[len(m.cmdHistory)-1] != content {
+				// Avoid duplicates at the end, and keep passwords out of it
+				if !isSecretCommand(content) && (len(m.cmdHistory) == 0 || m.cmdHistory[len(m.cmdHistory)-1] != content) {
 					m.cmdHistory = append(m.cmdHistory, content)
 				}
 				m.historyIdx = -1 // Reset history index
@@ -188,8 +314,10 @@ func (m modelState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					parts := strings.Fields(content)
 					if len(parts) == 2 {
 						host := parts[1]
+						m.connGen++
+						m.reconnecting = false
 						return m, func() tea.Msg {
-							err := m.network.Connect(host)
+							err := m.network.Connect(host, savedToken(host), nil, "")
 							if err != nil {
 								return errMsg(err)
 							}
@@ -197,53 +325,226 @@ func (m modelState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 							return connectionMsg{connected: true, host: host}
 						}
 					}
-					m.messages = append(m.messages, "Usage: /connect <host>")
-					m.viewport.SetContent(strings.Join(m.messages, "\n"))
-					m.viewport.GotoBottom()
+					m.addNotice("Usage: /connect <host>")
 					return m, nil
 				}
 
+				if content == "/dm" || strings.HasPrefix(content, "/dm ") {
+					parts := strings.Fields(content)
+					if len(parts) > 2 {
+						m.addNotice("Usage: /dm <user> to open a conversation, /dm to go back to the room")
+						return m, nil
+					}
+					peer := ""
+					if len(parts) == 2 {
+						peer = parts[1]
+					}
+					if peer == m.dmPeer {
+						return m, nil
+					}
+					if peer == "" {
+						// The room kept its scrollback while we were away
+						return m, m.showRoom(m.currentRoom)
+					}
+					m.dmPeer = peer
+					m.show(newRoomBuffer())
+					if m.network.Token() == "" {
+						return m, nil
+					}
+					// The read loop keeps running, so fetch without restarting it
+					target := m.target()
+					host := m.Host
+					return m, func() tea.Msg {
+						msgs, err := m.network.FetchMessages(host, target, "", "", historyPageSize)
+						return historyLoadedMsg{target: target, messages: msgs, background: true, err: err}
+					}
+				}
+
+				if content == "/thread" || strings.HasPrefix(content, "/thread ") {
+					parts := strings.Fields(content)
+					if len(parts) != 2 {
+						m.addNotice("Usage: /thread <message_id>")
+						return m, nil
+					}
+					if m.network.Token() == "" {
+						m.addNotice("Please login first.")
+						return m, nil
+					}
+					id, host := strings.TrimPrefix(parts[1], "#"), m.Host
+					return m, func() tea.Msg {
+						msgs, err := m.network.FetchThread(host, id)
+						return threadLoadedMsg{id: id, messages: msgs, err: err}
+					}
+				}
+
+				// In a DM view, plain text goes to the peer
+				if m.dmPeer != "" && !strings.HasPrefix(content, "/") {
+					content = "/msg " + m.dmPeer + " " + content
+				}
+
 				if content == "/disconnect" {
+					m.connGen++
+					m.reconnecting = false
 					m.network.Disconnect()
-					m.messages = append(m.messages, "Disconnected.")
-					m.viewport.SetContent(strings.Join(m.messages, "\n"))
-					m.viewport.GotoBottom()
+					m.addNotice("Disconnected.")
 					return m, nil
 				}
 
-				return m, m.network.SendMessage(content)
+				return m, m.network.SendMessage(content, m.currentRoom)
 			}
 		}
 
 	case connectionMsg:
 		if msg.connected {
 			m.Host = msg.host
-			// Connected, now fetch history
-			m.loading = true
-			return m, func() tea.Msg {
-				return historyFetchMsg{host: msg.host, room: m.currentRoom}
-			}
+			// A new connection starts out in general only
+			m.resetRooms()
+			// History needs a session, so it is fetched once we log in
+			m.network.SetToken("")
+			return m, m.network.WaitForMessage
 		}
 
 	case historyFetchMsg:
 		return m, func() tea.Msg {
-			msgs, err := m.network.FetchMessages(msg.host, msg.room)
-			if err != nil {
-				return errMsg(err)
+			if msg.after != "" {
+				msgs, err := m.network.FetchMessagesSince(msg.host, msg.target, msg.after, historyPageSize)
+				return historyLoadedMsg{target: msg.target, messages: msgs, backfill: true, err: err}
 			}
-			return historyLoadedMsg{messages: msgs}
+			msgs, err := m.network.FetchMessages(msg.host, msg.target, msg.before, "", historyPageSize)
+			return historyLoadedMsg{target: msg.target, messages: msgs, older: msg.before != "", err: err}
 		}
 
-	case historyLoadedMsg:
+	case disconnectedMsg:
+		if msg.manual {
+			return m, nil
+		}
+		if m.Host == "" {
+			m.addNotice("Disconnected from server.")
+			return m, nil
+		}
+		m.reconnecting = true
+		m.reconnectAttempt = 0
+		for _, b := range m.buffers() {
+			b.members = 0
+			b.typers = make(map[string]time.Time)
+		}
 		m.loading = false
-		// Process messages
-		for _, msg := range msg.messages {
-			m.messages = append(m.messages, formatMessage(msg, m.viewport.Width))
+		m.fetchingOlder = false
+		m.addNotice("Disconnected from server. Reconnecting...")
+		return m, scheduleReconnect(m.connGen, 0)
+
+	case reconnectMsg:
+		if msg.gen != m.connGen || !m.reconnecting {
+			return m, nil
 		}
-		m.viewport.SetContent(strings.Join(m.messages, "\n"))
-		m.viewport.GotoBottom()
+		m.reconnectAttempt = msg.attempt + 1
+		host, rooms, room := m.Host, m.roomNames(), m.currentRoom
+		token := m.network.Token()
+		return m, func() tea.Msg {
+			err := m.network.Connect(host, token, rooms, room)
+			return reconnectResultMsg{gen: msg.gen, attempt: msg.attempt, token: token, err: err}
+		}
+
+	case reconnectResultMsg:
+		if msg.gen != m.connGen || !m.reconnecting {
+			return m, nil
+		}
+		if msg.err != nil {
+			return m, scheduleReconnect(msg.gen, msg.attempt+1)
+		}
+		m.reconnecting = false
+		m.addNotice("Reconnected.")
+		// The server resumes our session; once it confirms, fetch what we missed
+		m.backfillPending = msg.token != ""
 		return m, m.network.WaitForMessage
 
+	case typingExpireMsg:
+		now := time.Now()
+		for _, b := range m.buffers() {
+			for user, until := range b.typers {
+				if now.After(until) {
+					delete(b.typers, user)
+				}
+			}
+		}
+		return m, nil
+
+	case threadLoadedMsg:
+		if msg.err != nil {
+			m.addNotice(fmt.Sprintf("Failed to load thread %s: %v", msg.id, msg.err))
+			return m, nil
+		}
+		// Shown as a block of notices so it doesn't mix with the live log
+		m.buf.lines = append(m.buf.lines, chatLine{text: metaStyle.Render(fmt.Sprintf("── Thread #%s (%d messages) ──", msg.id, len(msg.messages)))})
+		for _, threadMsg := range msg.messages {
+			m.buf.lines = append(m.buf.lines, chatLine{text: m.render(threadMsg)})
+		}
+		m.addNotice(metaStyle.Render("── End of thread ──"))
+		return m, nil
+
+	case historyLoadedMsg:
+		// Older pages and background loads arrive while the read loop is
+		// running; the other loads resume it
+		var cmd tea.Cmd
+		if !msg.older && !msg.background {
+			m.loading = false
+			cmd = m.network.WaitForMessage
+		}
+		b := m.bufferFor(msg.target)
+		if msg.err != nil {
+			m.fetchingOlder = false
+			if b != nil {
+				m.releaseHeld(b)
+			}
+			m.addNotice(fmt.Sprintf("Failed to load history: %v", msg.err))
+			return m, cmd
+		}
+		if b == nil {
+			// We left the room or closed the conversation meanwhile
+			if msg.older {
+				m.fetchingOlder = false
+			}
+			return m, cmd
+		}
+		if msg.older {
+			m.fetchingOlder = false
+			b.hasOlder = len(msg.messages) == historyPageSize
+			m.prependMessages(b, msg.messages)
+			return m, nil
+		}
+
+		b.loaded = true
+		if !msg.backfill {
+			b.hasOlder = len(msg.messages) == historyPageSize
+		}
+		// Entering a room: mark where the unread messages start
+		divider := -1
+		if unread := m.unread[msg.target.Room]; msg.target.Room != "" && !msg.backfill && unread.Count > 0 {
+			divider = max(len(msg.messages)-unread.Count, 0)
+			for i, chatMsg := range msg.messages {
+				if chatMsg.ID == unread.LastRead {
+					divider = i + 1
+				}
+			}
+		}
+		for i, chatMsg := range msg.messages {
+			if i == divider {
+				b.lines = append(b.lines, chatLine{text: newMessagesDivider(m.viewport.Width)})
+			}
+			m.appendMessage(b, chatMsg)
+		}
+		m.releaseHeld(b)
+		if b != m.buf {
+			return m, cmd
+		}
+		m.refreshViewport()
+		m.viewport.GotoBottom()
+
+		if m.dmPeer == "" && len(msg.messages) > 0 {
+			cmd = tea.Batch(cmd, m.network.SendMarkRead(msg.target.Room, msg.messages[len(msg.messages)-1].ID))
+		}
+		return m, cmd
+
 	case tea.WindowSizeMsg:
 		headerHeight := 1
 		footerHeight := 2 // Border + Input
@@ -261,78 +562,25 @@ func (m modelState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.textInput.Width = msg.Width
 
 	case model.Event:
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Recovered panic in Event handling: %v", r)
-				m.messages = append(m.messages, fmt.Sprintf("Error: %v", r))
-				m.viewport.SetContent(strings.Join(m.messages, "\n"))
-			}
-		}()
-
-		// Handle incoming event
-		if msg.Type == model.EventMessage {
-			payloadBytes, err := json.Marshal(msg.Payload)
-			if err != nil {
-				return m, m.network.WaitForMessage
-			}
-
-			var chatMsg model.Message
-			if err := json.Unmarshal(payloadBytes, &chatMsg); err != nil {
-				return m, m.network.WaitForMessage
-			}
-
-			formatted := formatMessage(chatMsg, m.viewport.Width)
-			m.messages = append(m.messages, formatted)
-			m.viewport.SetContent(strings.Join(m.messages, "\n"))
-			m.viewport.GotoBottom()
-			return m, m.network.WaitForMessage
-		} else if msg.Type == "room_join" {
-			// Handle room join
-			payloadBytes, _ := json.Marshal(msg.Payload)
-			var payload map[string]string
-			json.Unmarshal(payloadBytes, &payload)
-
-			newRoom := payload["room"]
-			if newRoom != "" {
-				m.currentRoom = newRoom
-				m.messages = []string{} // Clear messages
-				m.viewport.SetContent("")
-				m.loading = true
-
-				// We need host to fetch messages.
-				return m, func() tea.Msg {
-					return historyFetchMsg{host: m.Host, room: m.currentRoom}
-				}
-			}
-			return m, m.network.WaitForMessage
-		} else if msg.Type == "server_info" {
-			// Handle server info
-			payloadBytes, _ := json.Marshal(msg.Payload)
-			var payload map[string]string
-			json.Unmarshal(payloadBytes, &payload)
-
-			if name, ok := payload["server_name"]; ok {
-				m.ServerName = name
-			}
-			return m, m.network.WaitForMessage
-		}
-		return m, m.network.WaitForMessage
+		return m.handleEvent(msg)
 
 	case errMsg:
 		m.err = msg
 		// Check if it's a disconnect error
 		if strings.Contains(msg.Error(), "closed") || strings.Contains(msg.Error(), "connection reset") || strings.Contains(msg.Error(), "EOF") {
-			m.messages = append(m.messages, "Disconnected from server.")
+			m.addNotice("Disconnected from server.")
 		} else {
-			m.messages = append(m.messages, fmt.Sprintf("Error: %v", msg))
+			m.addNotice(fmt.Sprintf("Error: %v", msg))
 		}
-		m.viewport.SetContent(strings.Join(m.messages, "\n"))
-		m.viewport.GotoBottom()
 		m.loading = false
+		m.fetchingOlder = false
 		return m, nil
 	}
 
 	m.textInput, tiCmd = m.textInput.Update(msg)
+	if _, ok := msg.(tea.KeyMsg); ok {
+		tiCmd = tea.Batch(tiCmd, m.typingCmd())
+	}
 	// Only update viewport if it's NOT a key message that we want to ignore for scrolling
 	// But we already handled MouseMsg above and returned.
 	// For KeyMsg, we fell through.
@@ -353,6 +601,353 @@ func (m modelState) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, tea.Batch(tiCmd, vpCmd)
 }
 
+// handleEvent applies an event from the server. Unless the event leads to
+// a history fetch (which resumes reading afterwards) or ends the connection,
+// it returns WaitForMessage to keep reading.
+func (m modelState) handleEvent(event model.Event) (modelState, tea.Cmd) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered panic in Event handling: %v", r)
+			m.addNotice(fmt.Sprintf("Error: %v", r))
+		}
+	}()
+
+	switch event.Type {
+	case model.EventHello:
+		var hello model.HelloPayload
+		if err := event.Decode(&hello); err != nil {
+			m.addNotice("Error: " + err.Error())
+			break
+		}
+		if err := hello.CheckVersion("server"); err != nil {
+			m.connGen++
+			m.reconnecting = false
+			m.network.Disconnect()
+			m.addNotice("Cannot talk to this server: " + err.Error())
+			return m, nil
+		}
+		if hello.ServerName != "" {
+			m.ServerName = hello.ServerName
+		}
+
+	case model.EventMessage:
+		var chatMsg model.Message
+		if err := event.Decode(&chatMsg); err != nil {
+			log.Printf("Bad message event: %v", err)
+			break
+		}
+		// Messages without a room are notices for whatever is on screen
+		b := m.buf
+		if chatMsg.Room != "" {
+			b = m.rooms[chatMsg.Room]
+		}
+		if b == nil {
+			break
+		}
+		delete(b.typers, chatMsg.Sender)
+		if b.stale {
+			b.held = append(b.held, chatMsg)
+			break
+		}
+		if !m.appendMessage(b, chatMsg) {
+			break
+		}
+		cmds := []tea.Cmd{m.network.WaitForMessage}
+		if b == m.buf {
+			m.refreshViewport()
+			m.viewport.GotoBottom()
+			if chatMsg.ID != "" && chatMsg.Room != "" {
+				cmds = append(cmds, m.network.SendMarkRead(chatMsg.Room, chatMsg.ID))
+			}
+		}
+		if mentions(chatMsg, m.username) {
+			if b != m.buf {
+				m.addNotice(mentionStyle.Render(fmt.Sprintf("@ %s mentioned you in %s: %s", chatMsg.Sender, chatMsg.Room, chatMsg.Content)))
+			}
+			cmds = append(cmds, ringBell)
+		}
+		return m, tea.Batch(cmds...)
+
+	case model.EventMention:
+		var chatMsg model.Message
+		if err := event.Decode(&chatMsg); err != nil {
+			break
+		}
+		m.addNotice(mentionStyle.Render(fmt.Sprintf("@ %s mentioned you in %s: %s  (/mentions)", chatMsg.Sender, chatMsg.Room, chatMsg.Content)))
+		return m, tea.Batch(m.network.WaitForMessage, ringBell)
+
+	case model.EventUnread:
+		var payload model.UnreadPayload
+		if err := event.Decode(&payload); err != nil {
+			break
+		}
+		if payload.Full {
+			m.unread = make(map[string]model.RoomUnread)
+		}
+		for room, unread := range payload.Rooms {
+			m.unread[room] = unread
+		}
+
+	case model.EventTyping:
+		var payload model.TypingPayload
+		if err := event.Decode(&payload); err != nil || payload.User == m.username {
+			break
+		}
+		b := m.rooms[payload.Room]
+		if payload.Recipient != "" {
+			b = nil
+			if payload.User == m.dmPeer {
+				b = m.buf
+			}
+		}
+		if b == nil {
+			break
+		}
+		if !payload.Typing {
+			delete(b.typers, payload.User)
+			break
+		}
+		b.typers[payload.User] = time.Now().Add(typingTimeout)
+		return m, tea.Batch(m.network.WaitForMessage, tea.Tick(typingTimeout, func(time.Time) tea.Msg {
+			return typingExpireMsg{}
+		}))
+
+	case model.EventPresence:
+		var payload model.PresencePayload
+		if err := event.Decode(&payload); err != nil {
+			break
+		}
+		b := m.rooms[payload.Room]
+		if b == nil {
+			break
+		}
+		b.members = payload.Members
+		if payload.User == m.username {
+			break
+		}
+		name := payload.User
+		if payload.DisplayName != "" && payload.DisplayName != payload.User {
+			name = fmt.Sprintf("%s (%s)", payload.DisplayName, payload.User)
+		}
+		switch payload.State {
+		case model.PresenceJoin:
+			m.addNoticeTo(b, metaStyle.Render("→ "+name+" joined"))
+		case model.PresenceLeave:
+			delete(b.typers, payload.User)
+			m.addNoticeTo(b, metaStyle.Render("← "+name+" left"))
+		case model.PresenceAway:
+			text := "☾ " + name + " is away"
+			if payload.Message != "" {
+				text += ": " + payload.Message
+			}
+			m.addNoticeTo(b, metaStyle.Render(text))
+		}
+
+	case model.EventMessageEdited, model.EventMessageDeleted:
+		var chatMsg model.Message
+		if err := event.Decode(&chatMsg); err != nil {
+			log.Printf("Bad %s event: %v", event.Type, err)
+			break
+		}
+		if b := m.messageBuffer(chatMsg.Room); b != nil && m.replaceMessage(b, chatMsg) && b == m.buf {
+			m.refreshViewport()
+		}
+
+	case model.EventReactionUpdate:
+		var payload model.ReactionPayload
+		if err := event.Decode(&payload); err != nil {
+			log.Printf("Bad reaction event: %v", err)
+			break
+		}
+		if b := m.messageBuffer(payload.Room); b != nil && m.updateReactions(b, payload.MessageID, payload.Reactions) && b == m.buf {
+			m.refreshViewport()
+		}
+
+	case model.EventRoomJoin:
+		var payload model.RoomPayload
+		if err := event.Decode(&payload); err != nil || payload.Room == "" {
+			break
+		}
+		b, ok := m.rooms[payload.Room]
+		if !ok {
+			b = newRoomBuffer()
+			m.rooms[payload.Room] = b
+		}
+		b.topic = payload.Topic
+		b.archived = payload.Archived
+		markRead := m.showRoom(payload.Room)
+		if b.loaded {
+			// Back to a room we are still in, with its scrollback
+			return m, tea.Batch(m.network.WaitForMessage, markRead)
+		}
+		m.backfillPending = false
+		m.loading = true
+
+		// We need host to fetch messages.
+		return m, func() tea.Msg {
+			return historyFetchMsg{host: m.Host, target: m.target()}
+		}
+
+	case model.EventRoomUpdate:
+		var payload model.RoomPayload
+		if err := event.Decode(&payload); err != nil {
+			break
+		}
+		if b := m.rooms[payload.Room]; b != nil {
+			b.topic = payload.Topic
+			b.archived = payload.Archived
+		}
+
+	case model.EventRoomLeave:
+		var payload model.RoomPayload
+		if err := event.Decode(&payload); err != nil {
+			break
+		}
+		delete(m.rooms, payload.Room)
+		if payload.Room != m.currentRoom {
+			break
+		}
+		// The server names the room to switch to if this was its active
+		// room too; until then show another one we are in
+		if names := m.roomNames(); len(names) > 0 {
+			next := names[0]
+			if m.rooms["general"] != nil {
+				next = "general"
+			}
+			if m.dmPeer != "" {
+				m.currentRoom = next
+				break
+			}
+			return m, tea.Batch(m.network.WaitForMessage, m.showRoom(next))
+		}
+
+	case model.EventRoomChanged:
+		// The server also sends a notice saying what happened
+		var payload model.RoomChangePayload
+		if err := event.Decode(&payload); err != nil {
+			break
+		}
+		switch payload.Change {
+		case model.RoomRenamed:
+			if unread, ok := m.unread[payload.Room]; ok {
+				m.unread[payload.NewName] = unread
+				delete(m.unread, payload.Room)
+			}
+			if b, ok := m.rooms[payload.Room]; ok {
+				m.rooms[payload.NewName] = b
+				delete(m.rooms, payload.Room)
+			}
+			if m.currentRoom == payload.Room {
+				m.currentRoom = payload.NewName
+			}
+		case model.RoomRemoved:
+			delete(m.unread, payload.Room)
+		}
+
+	case model.EventDirectMessage:
+		var chatMsg model.Message
+		if err := event.Decode(&chatMsg); err != nil {
+			log.Printf("Bad direct message event: %v", err)
+			break
+		}
+		peer := chatMsg.Sender
+		if peer == m.username {
+			peer = chatMsg.Recipient
+		}
+		if peer == m.dmPeer {
+			delete(m.buf.typers, chatMsg.Sender)
+			if m.appendMessage(m.buf, chatMsg) {
+				m.refreshViewport()
+				m.viewport.GotoBottom()
+			}
+			break
+		}
+		if chatMsg.Sender != m.username {
+			m.addNotice(fmt.Sprintf("✉ DM from %s: %s  (/dm %s to open)", chatMsg.Sender, chatMsg.Content, chatMsg.Sender))
+		}
+
+	case model.EventSession:
+		var payload model.SessionPayload
+		if err := event.Decode(&payload); err != nil {
+			break
+		}
+
+		m.network.SetToken(payload.Token)
+		m.username = payload.Username
+		if payload.Token == "" {
+			// Logged out
+			forgetSession(m.Host)
+			break
+		}
+		if err := saveSession(m.Host, savedSession{Token: payload.Token, Username: payload.Username, Expires: payload.Expires}); err != nil {
+			log.Printf("Failed to save session: %v", err)
+		}
+		if m.backfillPending {
+			m.backfillPending = false
+			// Rooms not on screen catch up in the background
+			var cmds []tea.Cmd
+			for room, b := range m.rooms {
+				if last := b.newestMessageID(); b != m.buf && b.loaded && last != "" {
+					b.stale = true
+					cmds = append(cmds, m.backfillCmd(room, last))
+				}
+			}
+			if last := m.buf.newestMessageID(); last != "" {
+				cmds = append(cmds, func() tea.Msg {
+					return historyFetchMsg{host: m.Host, target: m.target(), after: last}
+				})
+				return m, tea.Batch(cmds...)
+			}
+			cmds = append(cmds, func() tea.Msg {
+				return historyFetchMsg{host: m.Host, target: m.target()}
+			})
+			m.loading = true
+			return m, tea.Batch(cmds...)
+		}
+		// Logged in: load the history we couldn't read before
+		m.loading = true
+		return m, func() tea.Msg {
+			return historyFetchMsg{host: m.Host, target: m.target()}
+		}
+
+	case model.EventRateLimited:
+		var payload model.RateLimitPayload
+		if err := event.Decode(&payload); err != nil {
+			break
+		}
+		m.addNotice(payload.Message)
+
+	case model.EventError:
+		var payload model.ErrorPayload
+		if err := event.Decode(&payload); err != nil {
+			break
+		}
+		switch payload.Code {
+		case model.ErrSessionInvalid:
+			forgetSession(m.Host)
+			m.network.SetToken("")
+			m.backfillPending = false
+		case model.ErrProtocolMismatch:
+			// The server hangs up; reconnecting would only fail again
+			m.connGen++
+			m.reconnecting = false
+			m.network.Disconnect()
+			m.addNotice("Cannot talk to this server: " + payload.Message)
+			return m, nil
+		case model.ErrBanned:
+			forgetSession(m.Host)
+			m.network.SetToken("")
+			m.connGen++
+			m.reconnecting = false
+			m.network.Disconnect()
+			m.addNotice(payload.Message)
+			return m, nil
+		}
+		m.addNotice("Error: " + payload.Message)
+	}
+	return m, m.network.WaitForMessage
+}
+
 func (m modelState) View() string {
 	if !m.ready {
 		return "\n  Initializing..."
@@ -371,13 +966,391 @@ func (m modelState) View() string {
 	)
 }
 
+// isSecretCommand reports whether a typed line carries a password and must
+// not be kept in the command history.
+func isSecretCommand(content string) bool {
+	if strings.HasPrefix(content, "/login ") || strings.HasPrefix(content, "/register ") ||
+		strings.HasPrefix(content, "/admin ") {
+		return true
+	}
+	// Room passwords: /room join <room> <password>, /room create <room> <visibility> <password>
+	fields := strings.Fields(content)
+	if len(fields) > 1 && fields[0] == "/room" {
+		return (fields[1] == "join" && len(fields) > 3) || (fields[1] == "create" && len(fields) > 4)
+	}
+	return fields != nil && fields[0] == "/join" && len(fields) > 2
+}
+
+// addNotice appends a local, non-chat line to the view and scrolls to it.
+func (m *modelState) addNotice(text string) {
+	m.addNoticeTo(m.buf, text)
+}
+
+// addNoticeTo appends a local, non-chat line to b, scrolling to it if b is
+// on screen.
+func (m *modelState) addNoticeTo(b *roomBuffer, text string) {
+	b.lines = append(b.lines, chatLine{text: text})
+	if b == m.buf {
+		m.refreshViewport()
+		m.viewport.GotoBottom()
+	}
+}
+
+// appendMessage renders msg at the end of b unless it is already shown.
+// It reports whether anything was added.
+func (m *modelState) appendMessage(b *roomBuffer, msg model.Message) bool {
+	if !b.markSeen(msg) {
+		return false
+	}
+	b.lines = append(b.lines, chatLine{msg: msg, text: m.render(msg)})
+	return true
+}
+
+// releaseHeld ends catching up in b, adding the live messages that arrived
+// meanwhile after the ones that were missed.
+func (m *modelState) releaseHeld(b *roomBuffer) {
+	b.stale = false
+	for _, msg := range b.held {
+		m.appendMessage(b, msg)
+	}
+	b.held = nil
+}
+
+// replaceMessage re-renders the line of b showing msg in place, along with
+// the quotes of any replies to it. It reports whether a line was changed.
+func (m *modelState) replaceMessage(b *roomBuffer, msg model.Message) bool {
+	if msg.ID == "" {
+		return false
+	}
+	changed := false
+	for i, line := range b.lines {
+		switch {
+		case line.msg.ID == msg.ID:
+			line.msg = msg
+		case line.msg.Quote != nil && line.msg.Quote.ID == msg.ID:
+			// Replies quote the current version of their parent
+			line.msg.Quote = &model.Quote{ID: msg.ID, Sender: msg.Sender, Content: msg.Content, Deleted: msg.Deleted}
+		default:
+			continue
+		}
+		line.text = m.render(line.msg)
+		b.lines[i] = line
+		changed = true
+	}
+	return changed
+}
+
+// updateReactions re-renders the message of b with the given ID with new
+// reaction counts. It reports whether the message is in b.
+func (m *modelState) updateReactions(b *roomBuffer, id string, reactions []model.Reaction) bool {
+	for i, line := range b.lines {
+		if id != "" && line.msg.ID == id {
+			line.msg.Reactions = reactions
+			line.text = m.render(line.msg)
+			b.lines[i] = line
+			return true
+		}
+	}
+	return false
+}
+
+// prependMessages renders an older page of history above the log of b
+// while keeping the visible lines in place.
+func (m *modelState) prependMessages(b *roomBuffer, msgs []model.Message) {
+	var older []chatLine
+	added := 0
+	for _, msg := range msgs {
+		if !b.markSeen(msg) {
+			continue
+		}
+		text := m.render(msg)
+		older = append(older, chatLine{msg: msg, text: text})
+		added += strings.Count(text, "\n") + 1
+	}
+	if len(older) == 0 {
+		return
+	}
+	b.lines = append(older, b.lines...)
+	if b != m.buf {
+		b.yOffset += added
+		return
+	}
+	m.refreshViewport()
+	m.viewport.SetYOffset(m.viewport.YOffset + added)
+}
+
+// refreshViewport puts the rendered lines of the buffer on screen into the
+// viewport.
+func (m *modelState) refreshViewport() {
+	texts := make([]string, len(m.buf.lines))
+	for i, line := range m.buf.lines {
+		texts[i] = line.text
+	}
+	m.viewport.SetContent(strings.Join(texts, "\n"))
+}
+
+// show puts b on screen, remembering where the buffer it replaces was
+// scrolled to.
+func (m *modelState) show(b *roomBuffer) {
+	if b == m.buf {
+		return
+	}
+	m.buf.yOffset = m.viewport.YOffset
+	m.buf.atBottom = m.viewport.AtBottom()
+	m.buf = b
+	m.refreshViewport()
+	if b.atBottom {
+		m.viewport.GotoBottom()
+	} else {
+		m.viewport.SetYOffset(b.yOffset)
+	}
+}
+
+// showRoom puts the buffer of room on screen and marks the room read up
+// to its newest message.
+func (m *modelState) showRoom(room string) tea.Cmd {
+	b, ok := m.rooms[room]
+	if !ok {
+		b = newRoomBuffer()
+		m.rooms[room] = b
+	}
+	m.currentRoom = room
+	m.dmPeer = ""
+	m.show(b)
+	if last := b.newestMessageID(); last != "" && m.network.Token() != "" {
+		return m.network.SendMarkRead(room, last)
+	}
+	return nil
+}
+
+// resetRooms drops every buffer and shows an empty general, where the
+// server puts a new connection.
+func (m *modelState) resetRooms() {
+	general := newRoomBuffer()
+	m.rooms = map[string]*roomBuffer{"general": general}
+	m.currentRoom = "general"
+	m.dmPeer = ""
+	m.buf = general
+	m.refreshViewport()
+}
+
+// roomNames lists the rooms we are in, sorted.
+func (m modelState) roomNames() []string {
+	names := make([]string, 0, len(m.rooms))
+	for room := range m.rooms {
+		names = append(names, room)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nextRoom returns the room step places away from the current one in the
+// sorted list of rooms we are in, or "" if there is no other room.
+func (m modelState) nextRoom(step int) string {
+	names := m.roomNames()
+	if len(names) < 2 {
+		return ""
+	}
+	i := sort.SearchStrings(names, m.currentRoom)
+	return names[((i+step)%len(names)+len(names))%len(names)]
+}
+
+// buffers lists every buffer: the rooms' and the one on screen.
+func (m modelState) buffers() []*roomBuffer {
+	var list []*roomBuffer
+	for _, b := range m.rooms {
+		list = append(list, b)
+	}
+	if m.dmPeer != "" {
+		list = append(list, m.buf)
+	}
+	return list
+}
+
+// bufferFor returns the buffer showing target, or nil if there is none.
+func (m modelState) bufferFor(target historyTarget) *roomBuffer {
+	if target.Peer != "" {
+		if target.Peer == m.dmPeer {
+			return m.buf
+		}
+		return nil
+	}
+	return m.rooms[target.Room]
+}
+
+// messageBuffer returns the buffer that would show a message of room; ""
+// stands for a direct message, which can only be on screen.
+func (m modelState) messageBuffer(room string) *roomBuffer {
+	if room == "" {
+		return m.buf
+	}
+	return m.rooms[room]
+}
+
+// backfillCmd fetches what room missed while we were disconnected, while
+// the read loop keeps running.
+func (m modelState) backfillCmd(room, after string) tea.Cmd {
+	host, target := m.Host, historyTarget{Room: room}
+	return func() tea.Msg {
+		msgs, err := m.network.FetchMessagesSince(host, target, after, historyPageSize)
+		return historyLoadedMsg{target: target, messages: msgs, backfill: true, background: true, err: err}
+	}
+}
+
+// oldestMessageID returns the ID of the oldest chat message in b.
+func (b *roomBuffer) oldestMessageID() string {
+	for _, line := range b.lines {
+		if line.msg.ID != "" {
+			return line.msg.ID
+		}
+	}
+	return ""
+}
+
+// target is the conversation the view currently shows.
+func (m modelState) target() historyTarget {
+	if m.dmPeer != "" {
+		return historyTarget{Peer: m.dmPeer}
+	}
+	return historyTarget{Room: m.currentRoom}
+}
+
+// newestMessageID returns the ID of the newest chat message in b.
+func (b *roomBuffer) newestMessageID() string {
+	for i := len(b.lines) - 1; i >= 0; i-- {
+		if b.lines[i].msg.ID != "" {
+			return b.lines[i].msg.ID
+		}
+	}
+	return ""
+}
+
+// markSeen records msg as shown in b and reports whether it was new.
+func (b *roomBuffer) markSeen(msg model.Message) bool {
+	if msg.ID == "" {
+		return true
+	}
+	if b.seenIDs[msg.ID] {
+		return false
+	}
+	b.seenIDs[msg.ID] = true
+	return true
+}
+
+// typingCmd tells the server when we start or stop typing a chat line.
+// While typing it repeats at most every typingThrottle.
+func (m *modelState) typingCmd() tea.Cmd {
+	if m.network.Token() == "" {
+		return nil
+	}
+	value := m.textInput.Value()
+	typing := value != "" && !strings.HasPrefix(value, "/")
+	now := time.Now()
+	if typing {
+		if m.isTyping && now.Sub(m.typingSent) < typingThrottle {
+			return nil
+		}
+		m.isTyping = true
+		m.typingSent = now
+		return m.network.SendTyping(true, m.currentRoom, m.dmPeer)
+	}
+	if !m.isTyping {
+		return nil
+	}
+	m.isTyping = false
+	return m.network.SendTyping(false, m.currentRoom, m.dmPeer)
+}
+
+// unreadBadges lists the rooms with unread messages, other than the one
+// on screen, like "random:3 dev:12".
+func (m modelState) unreadBadges() string {
+	var rooms []string
+	for room, unread := range m.unread {
+		if unread.Count > 0 && (room != m.currentRoom || m.dmPeer != "") {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	badges := make([]string, len(rooms))
+	for i, room := range rooms {
+		count := strconv.Itoa(m.unread[room].Count)
+		if m.unread[room].Count > 99 {
+			count = "99+"
+		}
+		badges[i] = room + ":" + count
+	}
+	return strings.Join(badges, " ")
+}
+
+// newMessagesDivider is drawn above the first unread message of a room.
+func newMessagesDivider(width int) string {
+	label := " new messages "
+	side := max((width-len(label))/2, 2)
+	style := lipgloss.NewStyle().Foreground(lipgloss.Color("#E17055"))
+	return style.Render(strings.Repeat("─", side) + label + strings.Repeat("─", side))
+}
+
+// typingText describes who is typing in the current view.
+func (m modelState) typingText() string {
+	now := time.Now()
+	var names []string
+	for user, until := range m.buf.typers {
+		if now.Before(until) {
+			names = append(names, user)
+		}
+	}
+	sort.Strings(names)
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0] + " is typing…"
+	case 2:
+		return names[0] + " and " + names[1] + " are typing…"
+	}
+	return fmt.Sprintf("%d people are typing…", len(names))
+}
+
 func (m modelState) headerView() string {
-	title := fmt.Sprintf(" %s [Room: %s] ", m.ServerName, m.currentRoom)
+	room := m.currentRoom
+	if m.buf.archived {
+		room += " (archived)"
+	}
+	if len(m.rooms) > 1 {
+		// Where we are among the rooms Ctrl+Left/Right cycles through
+		room += fmt.Sprintf(" %d/%d", sort.SearchStrings(m.roomNames(), m.currentRoom)+1, len(m.rooms))
+	}
+	title := fmt.Sprintf(" %s [Room: %s] ", m.ServerName, room)
+	if m.dmPeer != "" {
+		title = fmt.Sprintf(" %s [DM: %s] ", m.ServerName, m.dmPeer)
+	}
 	style := lipgloss.NewStyle().
 		Foreground(lipgloss.Color("#FFFFFF")).
 		Background(lipgloss.Color("#6C5CE7")). // Nice purple
 		Bold(true)
 
+	if m.dmPeer == "" && m.buf.topic != "" {
+		topic := []rune(m.buf.topic)
+		if len(topic) > topicWidth {
+			topic = append(topic[:topicWidth-1], '…')
+		}
+		title += "│ " + string(topic) + " "
+	}
+	if m.dmPeer == "" && m.buf.members > 0 {
+		title += fmt.Sprintf("👥 %d ", m.buf.members)
+	}
+	if badges := m.unreadBadges(); badges != "" {
+		title += " ✉ " + badges + " "
+	}
+	if typing := m.typingText(); typing != "" {
+		title += " " + typing + " "
+	}
+
+	if m.reconnecting {
+		title += fmt.Sprintf("⟳ Reconnecting (attempt %d)... ", max(m.reconnectAttempt, 1))
+		style = style.Background(lipgloss.Color("#E17055")) // Orange while offline
+	}
+
 	// Actually, let's just make a full width bar
 	width := m.viewport.Width
 	if width == 0 {
@@ -403,7 +1376,108 @@ func max(a, b int) int {
 	return b
 }
 
-func formatMessage(msg model.Message, width int) string {
+// shortIDLen is how much of a message ID is shown; the server accepts any
+// unique prefix in /edit and /delete.
+const shortIDLen = 6
+
+var (
+	metaStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("#707070"))
+	reactionStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#A0A0A0"))
+	mentionStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#FDCB6E")).Bold(true)
+)
+
+// messageBody renders the content column: the quoted parent of a reply,
+// the text (or a tombstone) followed by the edit marker and the short
+// message ID, and the reaction counts underneath.
+func messageBody(msg model.Message, self string) string {
+	var body string
+	if msg.Quote != nil {
+		body = quoteLine(*msg.Quote) + "\n"
+	}
+	if msg.Deleted {
+		text := "(message deleted)"
+		if msg.DeletedBy != "" && msg.DeletedBy != msg.Sender {
+			text = "(message deleted by " + msg.DeletedBy + ")"
+		}
+		body += metaStyle.Italic(true).Render(text)
+	} else if mentions(msg, self) {
+		// Mentioned by display name there may be no @username to light up,
+		// so the star always marks it
+		content := parseColorTags(msg.Content)
+		pattern := regexp.MustCompile(`(?i)@` + regexp.QuoteMeta(self) + `\b`)
+		content = pattern.ReplaceAllStringFunc(content, func(s string) string { return mentionStyle.Render(s) })
+		body += mentionStyle.Render("★") + " " + content
+	} else {
+		body += parseColorTags(msg.Content)
+	}
+
+	var meta []string
+	if msg.EditedAt != nil && !msg.Deleted {
+		meta = append(meta, "(edited)")
+	}
+	if len(msg.ID) >= shortIDLen {
+		meta = append(meta, "#"+msg.ID[:shortIDLen])
+	}
+	if len(meta) > 0 {
+		body += " " + metaStyle.Render(strings.Join(meta, " "))
+	}
+	if len(msg.Reactions) > 0 && !msg.Deleted {
+		counts := make([]string, len(msg.Reactions))
+		for i, r := range msg.Reactions {
+			counts[i] = fmt.Sprintf("%s %d", r.Emoji, len(r.Users))
+		}
+		body += "\n" + reactionStyle.Render(strings.Join(counts, "  "))
+	}
+	return body
+}
+
+// topicWidth is how many characters of the room topic fit in the header.
+const topicWidth = 40
+
+// quoteWidth is how many characters of a quoted message are shown.
+const quoteWidth = 48
+
+// quoteLine renders the excerpt of the message a reply answers.
+func quoteLine(q model.Quote) string {
+	text := "(message deleted)"
+	if !q.Deleted {
+		content := []rune(strings.ReplaceAll(q.Content, "\n", " "))
+		if len(content) > quoteWidth {
+			content = append(content[:quoteWidth-1], '…')
+		}
+		text = string(content)
+	}
+	return metaStyle.Render(fmt.Sprintf("↪ %s: %s", q.Sender, text))
+}
+
+// render formats msg for the viewport.
+func (m modelState) render(msg model.Message) string {
+	return formatMessage(msg, m.viewport.Width, m.username)
+}
+
+// mentions reports whether msg mentions user.
+func mentions(msg model.Message, user string) bool {
+	if user == "" {
+		return false
+	}
+	for _, name := range msg.Mentions {
+		if name == user {
+			return true
+		}
+	}
+	return false
+}
+
+// ringBell beeps the terminal. It goes to stderr so it can't land in the
+// middle of a screen update.
+func ringBell() tea.Msg {
+	os.Stderr.WriteString("\a")
+	return nil
+}
+
+// formatMessage renders msg as viewport lines. self is our username, used
+// to highlight mentions of us.
+func formatMessage(msg model.Message, width int, self string) string {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Panic in formatMessage: %v, msg: %+v", r, msg)
@@ -476,7 +1550,7 @@ func formatMessage(msg model.Message, width int) string {
 		msgWidth = 10
 	}
 
-	contentWithColors := parseColorTags(msg.Content)
+	contentWithColors := messageBody(msg, self)
 	wrapped := lipgloss.NewStyle().Width(msgWidth).Render(contentWithColors)
 	lines := strings.Split(wrapped, "\n")
 
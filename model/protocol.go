@@ -0,0 +1,231 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ProtocolVersion is the version of the websocket protocol spoken by this
+// build. Client and server exchange it in EventHello and refuse to talk to
+// a peer on a different version.
+const ProtocolVersion = 2
+
+// EventType represents the type of websocket event.
+type EventType string
+
+const (
+	// Client <-> Server
+	EventHello   EventType = "hello"   // HelloPayload, first event in each direction
+	EventMessage EventType = "message" // Client: SendPayload; Server: Message
+	EventTyping  EventType = "typing"  // TypingPayload; Client: own state; Server: someone else's
+
+	// Client -> Server
+	EventMarkRead EventType = "mark_read" // ReadPayload
+
+	// Server -> Client
+	EventDirectMessage  EventType = "direct_message"  // Message with Recipient set
+	EventMessageEdited  EventType = "message_edited"  // Message, the new version
+	EventMessageDeleted EventType = "message_deleted" // Message, the tombstone
+	EventReactionUpdate EventType = "reaction_update" // ReactionPayload
+	EventError          EventType = "error"           // ErrorPayload
+	EventSession        EventType = "session"         // SessionPayload, sent after login
+	EventRoomJoin       EventType = "room_join"       // RoomPayload, the client joined a room (if not in it already) and made it active
+	EventRoomLeave      EventType = "room_leave"      // RoomPayload, the client no longer gets a room's events
+	EventRoomUpdate     EventType = "room_update"     // RoomPayload, a room's details changed
+	EventRoomChanged    EventType = "room_changed"    // RoomChangePayload
+	EventPresence       EventType = "presence"        // PresencePayload
+	EventUnread         EventType = "unread"          // UnreadPayload
+	EventMention        EventType = "mention"         // Message mentioning you in a room you're not in
+	EventRateLimited    EventType = "rate_limited"    // RateLimitPayload, what the client sent was dropped
+
+	// Unused, logins go through the /login command
+	EventLogin EventType = "login"
+)
+
+// Event is the wrapper for websocket messages. Payload holds the JSON of
+// the payload type documented next to each EventType.
+type Event struct {
+	Type    EventType       `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// NewEvent builds an event with payload encoded as JSON.
+func NewEvent(t EventType, payload interface{}) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, fmt.Errorf("encode %s payload: %w", t, err)
+	}
+	return Event{Type: t, Payload: data}, nil
+}
+
+// EncodeEvent builds an event and encodes it for the wire.
+func EncodeEvent(t EventType, payload interface{}) ([]byte, error) {
+	event, err := NewEvent(t, payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(event)
+}
+
+// Decode unmarshals the payload into v, which should be the payload type
+// documented for e.Type.
+func (e Event) Decode(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return fmt.Errorf("%s event has no payload", e.Type)
+	}
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("invalid %s payload (protocol v%d): %w", e.Type, ProtocolVersion, err)
+	}
+	return nil
+}
+
+// HelloPayload opens the conversation. The server's hello also carries its
+// name.
+type HelloPayload struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	ServerName      string `json:"server_name,omitempty"`
+}
+
+// CheckVersion returns an error explaining the mismatch if the peer speaks
+// a different protocol version.
+func (h HelloPayload) CheckVersion(peer string) error {
+	if h.ProtocolVersion == ProtocolVersion {
+		return nil
+	}
+	if h.ProtocolVersion < ProtocolVersion {
+		return fmt.Errorf("%s speaks protocol v%d but this build needs v%d; the %s needs to be updated",
+			peer, h.ProtocolVersion, ProtocolVersion, peer)
+	}
+	return fmt.Errorf("%s speaks protocol v%d but this build only supports v%d; please update this build",
+		peer, h.ProtocolVersion, ProtocolVersion)
+}
+
+// SendPayload is a line typed by the user: chat text or a /command. Room
+// is the room the user has on screen; if the connection is in it, it
+// becomes the active room that chat text is posted to.
+type SendPayload struct {
+	Content string `json:"content"`
+	Room    string `json:"room,omitempty"`
+}
+
+// RoomPayload names a room, with the details shown while in it.
+type RoomPayload struct {
+	Room     string `json:"room"`
+	Topic    string `json:"topic,omitempty"`
+	Archived bool   `json:"archived,omitempty"` // Read-only
+}
+
+// Room changes sent in RoomChangePayload.
+const (
+	RoomRenamed  = "renamed"
+	RoomArchived = "archived"
+	RoomRestored = "restored"
+	RoomRemoved  = "removed"
+)
+
+// RoomChangePayload tells everyone who can read a room that it was
+// renamed, archived, restored or removed. NewName is set when renamed.
+type RoomChangePayload struct {
+	Room    string `json:"room"`
+	Change  string `json:"change"`
+	NewName string `json:"new_name,omitempty"`
+	By      string `json:"by,omitempty"`
+}
+
+// LoginPayload is the payload for login/register requests.
+type LoginPayload struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SessionPayload carries the credential a client uses for the REST API and
+// to resume its login on reconnect. An empty Token means the client was
+// logged out and should forget any saved token.
+type SessionPayload struct {
+	Token    string    `json:"token"`
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+}
+
+// ReactionPayload carries the current reactions of a message.
+type ReactionPayload struct {
+	MessageID string     `json:"message_id"`
+	Room      string     `json:"room,omitempty"`
+	Reactions []Reaction `json:"reactions"`
+}
+
+// TypingPayload says whether a user is typing. The client sends it with
+// Room set to the room it is typing in, or Recipient set when typing a
+// direct message; the server fills in User when passing it on.
+type TypingPayload struct {
+	Typing    bool   `json:"typing"`
+	User      string `json:"user,omitempty"`
+	Room      string `json:"room,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+}
+
+// Presence states sent in PresencePayload.
+const (
+	PresenceJoin   = "join"   // Entered the room
+	PresenceLeave  = "leave"  // Left the room or disconnected
+	PresenceIdle   = "idle"   // No activity for a while
+	PresenceAway   = "away"   // Marked themselves away with /away
+	PresenceActive = "active" // Back from idle or away
+)
+
+// PresencePayload reports a change in who is in a room. Members is the
+// number of users in the room after the change.
+type PresencePayload struct {
+	Room        string `json:"room"`
+	User        string `json:"user"`
+	DisplayName string `json:"display_name,omitempty"`
+	State       string `json:"state"`
+	Message     string `json:"message,omitempty"` // Away message
+	Members     int    `json:"members"`
+}
+
+// ReadPayload marks everything up to MessageID in Room as read.
+type ReadPayload struct {
+	Room      string `json:"room"`
+	MessageID string `json:"message_id"`
+}
+
+// RoomUnread is how far a user has read in a room.
+type RoomUnread struct {
+	Count    int    `json:"count"`               // Messages after LastRead
+	LastRead string `json:"last_read,omitempty"` // ID of the last message read
+}
+
+// UnreadPayload carries unread counts by room. A Full payload lists every
+// room the user can read and replaces what the client knew; otherwise
+// only the rooms that changed are included.
+type UnreadPayload struct {
+	Rooms map[string]RoomUnread `json:"rooms"`
+	Full  bool                  `json:"full,omitempty"`
+}
+
+// RateLimitPayload warns a client that it sent faster than the server
+// allows, or than a room's slow mode lets it post. Warning counts up to
+// MuteAfter; one more and the user is muted for a while.
+type RateLimitPayload struct {
+	Kind       string `json:"kind"`        // "message", "command", "login" or "slow_mode"
+	RetryAfter int    `json:"retry_after"` // Seconds
+	Warning    int    `json:"warning,omitempty"`
+	MuteAfter  int    `json:"mute_after,omitempty"`
+	Message    string `json:"message"`
+}
+
+// ErrorPayload is the payload of an EventError.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes sent in ErrorPayload.
+const (
+	ErrSessionInvalid   = "session_invalid"   // Saved session token was rejected
+	ErrProtocolMismatch = "protocol_mismatch" // Peers speak different protocol versions
+	ErrInvalidPayload   = "invalid_payload"   // Payload didn't match its event type
+	ErrBanned           = "banned"            // The account or address is banned; the server hangs up
+)
@@ -9,37 +9,45 @@ type User struct {
 	PasswordHash string   `json:"password_hash"` // Stored as hash
 	IPID         string   `json:"ip_id"`         // 15 chars fixed length like "XXX.XXX.XXX.XXX"
 	Clans        []string `json:"clans"`         // List of clan tags
-	IsAdmin      bool     `json:"is_admin"`      // Persistent admin status
+
+	Role    string `json:"role,omitempty"`     // Server-wide role; empty means member
+	IsAdmin bool   `json:"is_admin,omitempty"` // Deprecated: moved to Role when the server loads users
 }
 
 // Message represents a chat message.
 type Message struct {
+	ID            string    `json:"id,omitempty"`   // Server-assigned unique ID
+	Seq           int64     `json:"seq,omitempty"`  // Position in the room, starting at 1
 	Sender        string    `json:"sender"`         // Username
 	SenderDisplay string    `json:"sender_display"` // Username with clan tags/colors
 	SenderID      string    `json:"sender_id"`      // IPID
 	Content       string    `json:"content"`
-	Room          string    `json:"room"` // Chat room name
+	Room          string    `json:"room"`                // Chat room name, empty for direct messages
+	Recipient     string    `json:"recipient,omitempty"` // Username, set on direct messages
 	Timestamp     time.Time `json:"timestamp"`
 	IsSystem      bool      `json:"is_system"` // True if it's a system message
-}
 
-// EventType represents the type of websocket event.
-type EventType string
+	Mentions  []string   `json:"mentions,omitempty"`  // Usernames @mentioned in Content
+	Reactions []Reaction `json:"reactions,omitempty"` // In the order they were first used
 
-const (
-	EventMessage EventType = "message"
-	EventLogin   EventType = "login"
-	EventError   EventType = "error"
-)
+	ReplyTo string `json:"reply_to,omitempty"` // ID of the message this answers
+	Quote   *Quote `json:"quote,omitempty"`    // Excerpt of the ReplyTo message, filled in by the server
+
+	EditedAt  *time.Time `json:"edited_at,omitempty"`  // Set once the author edits it
+	Deleted   bool       `json:"deleted,omitempty"`    // Tombstone: content has been removed
+	DeletedBy string     `json:"deleted_by,omitempty"` // Username of who deleted it
+}
 
-// Event is the wrapper for websocket messages.
-type Event struct {
-	Type    EventType   `json:"type"`
-	Payload interface{} `json:"payload"`
+// Reaction is one emoji reacted to a message and who used it.
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Users []string `json:"users"` // Usernames; the count is len(Users)
 }
 
-// LoginPayload is the payload for login/register requests.
-type LoginPayload struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+// Quote is a short excerpt of the message a reply answers.
+type Quote struct {
+	ID      string `json:"id"`
+	Sender  string `json:"sender"`
+	Content string `json:"content"` // Truncated, empty if Deleted
+	Deleted bool   `json:"deleted,omitempty"`
 }
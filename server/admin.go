@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/charmbracelet/x/term"
+)
+
+const (
+	// minAdminPasswordLength is the shortest admin password server init
+	// accepts.
+	minAdminPasswordLength = 12
+
+	// adminFreeAttempts is how many wrong admin passwords an account or
+	// address may try before it has to wait.
+	adminFreeAttempts = 3
+
+	// adminLockout is the first wait after too many wrong passwords. It
+	// doubles with every further miss, up to adminMaxLockout.
+	adminLockout    = 30 * time.Second
+	adminMaxLockout = time.Hour
+
+	// adminForgetAfter is how long after the last miss the count starts
+	// over.
+	adminForgetAfter = 24 * time.Hour
+)
+
+// checkAdminPassword reports why password is too weak to be the admin
+// password, or nil if it is strong enough.
+func checkAdminPassword(password string) error {
+	if len([]rune(password)) < minAdminPasswordLength {
+		return errors.New("must be at least 12 characters long")
+	}
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	kinds := 0
+	for _, ok := range []bool{lower, upper, digit, other} {
+		if ok {
+			kinds++
+		}
+	}
+	if kinds < 3 {
+		return errors.New("must mix at least three of lowercase letters, uppercase letters, digits and symbols")
+	}
+	lowered := strings.ToLower(password)
+	for _, word := range []string{"admin", "password", "cmppchat"} {
+		if strings.Contains(lowered, word) {
+			return errors.New("must not contain \"" + word + "\"")
+		}
+	}
+	return nil
+}
+
+// promptAdminPassword asks on the terminal for a new admin password until
+// a strong one is given twice, and saves it in config. Input is hidden when
+// stdin is a terminal; otherwise it is read line by line, for scripts.
+func promptAdminPassword(config *Config) error {
+	in := bufio.NewReader(os.Stdin)
+	read := func(prompt string) (string, error) {
+		fmt.Print(prompt)
+		if term.IsTerminal(os.Stdin.Fd()) {
+			line, err := term.ReadPassword(os.Stdin.Fd())
+			fmt.Println()
+			return string(line), err
+		}
+		line, err := in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	fmt.Printf("Set the admin password (at least %d characters, mixing letters, digits and symbols).\n", minAdminPasswordLength)
+	for {
+		password, err := read("Admin password: ")
+		if err != nil {
+			return err
+		}
+		if err := checkAdminPassword(password); err != nil {
+			fmt.Printf("The password %v.\n", err)
+			continue
+		}
+		again, err := read("Repeat admin password: ")
+		if err != nil {
+			return err
+		}
+		if again != password {
+			fmt.Println("The passwords don't match.")
+			continue
+		}
+		return config.SetAdminPassword(password)
+	}
+}
+
+// remoteHost is the address a request came from, without the port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// adminAttempt counts the wrong admin passwords tried by one account or
+// from one address.
+type adminAttempt struct {
+	misses   int
+	lastMiss time.Time
+	until    time.Time // No tries before this
+}
+
+// AdminAttempts slows down guessing the admin password. Misses are
+// counted per account and per remote address, and the longer wait of the
+// two applies.
+type AdminAttempts struct {
+	byKey map[string]*adminAttempt // Key: "user:" + username or "addr:" + address
+	mu    sync.Mutex
+}
+
+func NewAdminAttempts() *AdminAttempts {
+	return &AdminAttempts{byKey: make(map[string]*adminAttempt)}
+}
+
+func adminAttemptKeys(username, addr string) []string {
+	keys := []string{"user:" + username}
+	if addr != "" {
+		keys = append(keys, "addr:"+addr)
+	}
+	return keys
+}
+
+// Wait returns how long username at addr has to wait before trying again,
+// or 0 if they may try now.
+func (a *AdminAttempts) Wait(username, addr string) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range adminAttemptKeys(username, addr) {
+		if at, ok := a.byKey[key]; ok && at.until.After(now) {
+			if d := at.until.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// Miss records a wrong password and returns how long username at addr now
+// has to wait.
+func (a *AdminAttempts) Miss(username, addr string) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range adminAttemptKeys(username, addr) {
+		at, ok := a.byKey[key]
+		if !ok || now.Sub(at.lastMiss) > adminForgetAfter {
+			at = &adminAttempt{}
+			a.byKey[key] = at
+		}
+		at.misses++
+		at.lastMiss = now
+		if at.misses >= adminFreeAttempts {
+			lockout := adminLockout << (at.misses - adminFreeAttempts)
+			if lockout > adminMaxLockout || lockout <= 0 {
+				lockout = adminMaxLockout
+			}
+			at.until = now.Add(lockout)
+			if lockout > wait {
+				wait = lockout
+			}
+		}
+	}
+	return wait
+}
+
+// Reset forgets the misses of username and addr after a right password.
+func (a *AdminAttempts) Reset(username, addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, key := range adminAttemptKeys(username, addr) {
+		delete(a.byKey, key)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// apiHandler serves a REST request made by a logged-in user.
+type apiHandler func(w http.ResponseWriter, r *http.Request, user *model.User)
+
+// registerAPI installs the REST endpoints. All of them need the session
+// token a client receives when it logs in over the websocket.
+func registerAPI(hub *Hub) {
+	http.HandleFunc("/api/messages", hub.requireSession(hub.serveRoomHistory))
+	http.HandleFunc("/api/dm", hub.requireSession(hub.serveDirectHistory))
+	http.HandleFunc("/api/thread", hub.requireSession(hub.serveThread))
+	http.HandleFunc("/api/modlog", hub.requireSession(hub.serveModLog))
+}
+
+// requireSession rejects requests without a valid session token.
+func (h *Hub) requireSession(next apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		sess, ok := h.sessions.Lookup(bearerToken(r))
+		if !ok {
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		user, ok := h.store.GetUser(sess.Username)
+		if !ok {
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		if ban, ok := h.bans.Active(SanctionBan, user); ok {
+			http.Error(w, banNotice(ban), http.StatusForbidden)
+			return
+		}
+		if ban, ok := h.bans.BannedAddr(remoteHost(r)); ok {
+			http.Error(w, banNotice(ban), http.StatusForbidden)
+			return
+		}
+		next(w, r, user)
+	}
+}
+
+// GET /api/messages?room=<room>[&before=<cursor>][&after=<cursor>][&limit=<n>]
+func (h *Hub) serveRoomHistory(w http.ResponseWriter, r *http.Request, user *model.User) {
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = "general"
+	}
+	if !h.CanReadRoom(user, room) {
+		http.Error(w, "access to room denied", http.StatusForbidden)
+		return
+	}
+
+	before, after, limit, err := parseHistoryQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	messages, err := h.store.GetMessagesPage(room, before, after, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, messages)
+}
+
+// GET /api/dm?with=<user>[&before=<cursor>][&after=<cursor>][&limit=<n>]
+//
+// Returns the caller's direct messages with the given user. Only the exact
+// username is accepted, so a display name can't stand in for someone else.
+func (h *Hub) serveDirectHistory(w http.ResponseWriter, r *http.Request, user *model.User) {
+	with := r.URL.Query().Get("with")
+	if with == "" {
+		http.Error(w, "with must name a user", http.StatusBadRequest)
+		return
+	}
+	peer, ok := h.store.GetUser(with)
+	if !ok {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	before, after, limit, err := parseHistoryQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	messages, err := h.store.GetDirectMessagesPage(user.Username, peer.Username, before, after, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, messages)
+}
+
+// GET /api/thread?id=<message_id>
+//
+// Returns the whole thread the message belongs to, oldest first. The ID may
+// be a unique prefix.
+func (h *Hub) serveThread(w http.ResponseWriter, r *http.Request, user *model.User) {
+	id, err := h.store.ResolveMessageID(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	msg, _ := h.store.GetMessage(id)
+	if !h.CanReadMessage(user, msg) {
+		// Don't tell outsiders the message exists
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+
+	thread, err := h.store.GetThread(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, thread)
+}
+
+// parseHistoryQuery reads the before, after and limit query parameters.
+func parseHistoryQuery(r *http.Request) (before, after HistoryCursor, limit int, err error) {
+	query := r.URL.Query()
+	limit = defaultHistoryLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return before, after, 0, fmt.Errorf("invalid limit")
+		}
+		limit = n
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	return parseCursor(query.Get("before")), parseCursor(query.Get("after")), limit, nil
+}
+
+// parseCursor reads a history cursor given as an RFC 3339 timestamp or a
+// message ID.
+func parseCursor(v string) HistoryCursor {
+	if v == "" {
+		return HistoryCursor{}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return HistoryCursor{Time: t}
+	}
+	return HistoryCursor{ID: v}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+// Kinds of sanction.
+const (
+	SanctionBan  = "ban"  // Keeps the user off the server
+	SanctionMute = "mute" // Lets the user read but not send
+)
+
+// sanctionExpiryInterval is how often bans and mutes that ran out are
+// lifted.
+const sanctionExpiryInterval = time.Minute
+
+// Sanction is a ban or mute of one user, or a ban of a network address.
+type Sanction struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	Username string     `json:"username,omitempty"` // Empty for old bans of an IPID nobody had
+	IPID     string     `json:"ip_id,omitempty"`
+	Addr     string     `json:"addr,omitempty"` // IP address or CIDR range, for address bans
+	Reason   string     `json:"reason,omitempty"`
+	By       string     `json:"by"` // Username of the moderator, grantByConsole or floodProtection
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"` // Nil until lifted by hand
+
+	SeenAddrs []string `json:"seen_addrs,omitempty"` // Where a banned user was connected from, to spot evasion
+}
+
+// expired reports whether the sanction ran out by now.
+func (s *Sanction) expired(now time.Time) bool {
+	return s.Expires != nil && !now.Before(*s.Expires)
+}
+
+// matches reports whether the sanction is of username or ipid.
+func (s *Sanction) matches(username, ipid string) bool {
+	return (s.Username != "" && s.Username == username) || (s.IPID != "" && s.IPID == ipid)
+}
+
+// matchesAddr reports whether the sanction is of a range addr is in.
+func (s *Sanction) matchesAddr(addr string) bool {
+	if s.Addr == "" || addr == "" {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	if _, network, err := net.ParseCIDR(s.Addr); err == nil {
+		return ip != nil && network.Contains(ip)
+	}
+	if banned := net.ParseIP(s.Addr); banned != nil && ip != nil {
+		return banned.Equal(ip)
+	}
+	return s.Addr == addr
+}
+
+// until describes when the sanction ends.
+func (s *Sanction) until() string {
+	if s.Expires == nil {
+		return "until lifted"
+	}
+	return "until " + s.Expires.Format("2006-01-02 15:04")
+}
+
+// target names who the sanction is against.
+func (s *Sanction) target() string {
+	switch {
+	case s.Username != "":
+		return s.Username
+	case s.Addr != "":
+		return s.Addr
+	}
+	return s.IPID
+}
+
+// Sanctions keeps the bans and mutes, apart from the server config.
+type Sanctions struct {
+	list []*Sanction
+	mu   sync.RWMutex
+	file string
+}
+
+func NewSanctions(file string) *Sanctions {
+	return &Sanctions{file: file}
+}
+
+// Load reads the sanctions, and moves over the IPIDs older versions
+// banned in the config.
+func (s *Sanctions) Load(config *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.file)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &s.list); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	config.mu.Lock()
+	banned := config.BannedIPIDs
+	config.BannedIPIDs = nil
+	config.mu.Unlock()
+	if len(banned) == 0 {
+		return nil
+	}
+	for _, ipid := range banned {
+		if s.activeInternal(SanctionBan, "", ipid, time.Now()) == nil {
+			s.list = append(s.list, &Sanction{
+				ID:      newMessageID(),
+				Kind:    SanctionBan,
+				IPID:    ipid,
+				By:      grantByConsole,
+				Created: time.Now(),
+			})
+		}
+	}
+	if err := s.saveInternal(); err != nil {
+		return err
+	}
+	// Only drop the old list once the bans are safely in their own file
+	return config.Save()
+}
+
+// Helper to save sanctions without locking (must be called with lock held)
+func (s *Sanctions) saveInternal() error {
+	data, err := json.MarshalIndent(s.list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.file, data, 0644)
+}
+
+// activeInternal finds the sanction of kind in force against username or
+// ipid. Must be called with lock held.
+func (s *Sanctions) activeInternal(kind, username, ipid string, now time.Time) *Sanction {
+	for _, sanction := range s.list {
+		if sanction.Kind == kind && sanction.matches(username, ipid) && !sanction.expired(now) {
+			return sanction
+		}
+	}
+	return nil
+}
+
+// Active returns the sanction of kind in force against user, if any.
+func (s *Sanctions) Active(kind string, user *model.User) (Sanction, bool) {
+	if user == nil {
+		return Sanction{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if sanction := s.activeInternal(kind, user.Username, user.IPID, time.Now()); sanction != nil {
+		return *sanction, true
+	}
+	return Sanction{}, false
+}
+
+// BannedAddr returns the ban in force of a range addr is in, if any.
+func (s *Sanctions) BannedAddr(addr string) (Sanction, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, sanction := range s.list {
+		if sanction.Kind == SanctionBan && sanction.matchesAddr(addr) && !sanction.expired(now) {
+			return *sanction, true
+		}
+	}
+	return Sanction{}, false
+}
+
+// SeenAt returns a ban in force of a user who was connected from addr, if
+// any.
+func (s *Sanctions) SeenAt(addr string) (Sanction, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, sanction := range s.list {
+		if sanction.Kind != SanctionBan || sanction.expired(now) {
+			continue
+		}
+		for _, seen := range sanction.SeenAddrs {
+			if seen == addr {
+				return *sanction, true
+			}
+		}
+	}
+	return Sanction{}, false
+}
+
+// Add puts a sanction in force. One already in force against the same
+// user is replaced, so banning again changes the length and reason.
+func (s *Sanctions) Add(sanction Sanction) (Sanction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sanction.ID = newMessageID()
+	sanction.Created = now
+	old := s.activeInternal(sanction.Kind, sanction.Username, sanction.IPID, now)
+	if sanction.Addr != "" {
+		old = nil
+		for _, o := range s.list {
+			if o.Kind == sanction.Kind && o.Addr == sanction.Addr && !o.expired(now) {
+				old = o
+			}
+		}
+	}
+	if old != nil {
+		*old = sanction
+	} else {
+		s.list = append(s.list, &sanction)
+	}
+	return sanction, s.saveInternal()
+}
+
+// Lift ends the sanctions of kind against username, ipid or the address
+// range addr before they run out, and returns them.
+func (s *Sanctions) Lift(kind, username, ipid, addr string) ([]Sanction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lifted []Sanction
+	kept := s.list[:0]
+	for _, sanction := range s.list {
+		if sanction.Kind == kind && (sanction.matches(username, ipid) || (addr != "" && sanction.Addr == addr)) {
+			lifted = append(lifted, *sanction)
+			continue
+		}
+		kept = append(kept, sanction)
+	}
+	s.list = kept
+	if len(lifted) == 0 {
+		return nil, nil
+	}
+	return lifted, s.saveInternal()
+}
+
+// Expire removes the sanctions that ran out by now and returns them.
+func (s *Sanctions) Expire(now time.Time) ([]Sanction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []Sanction
+	kept := s.list[:0]
+	for _, sanction := range s.list {
+		if sanction.expired(now) {
+			expired = append(expired, *sanction)
+			continue
+		}
+		kept = append(kept, sanction)
+	}
+	s.list = kept
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	return expired, s.saveInternal()
+}
+
+// List returns the sanctions of kind in force, oldest first, or all of
+// them if kind is empty.
+func (s *Sanctions) List(kind string) []Sanction {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var list []Sanction
+	for _, sanction := range s.list {
+		if (kind == "" || sanction.Kind == kind) && !sanction.expired(now) {
+			list = append(list, *sanction)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// sanctionExpiry is who lifts sanctions that ran out, in the moderation
+// log.
+const sanctionExpiry = "(expiry)"
+
+// StartExpiry lifts bans and mutes as they run out, checking every
+// interval. It runs until the process exits.
+func (h *Hub) StartExpiry(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			expired, err := h.bans.Expire(now)
+			if err != nil {
+				log.Printf("Failed to save expired bans: %v", err)
+			}
+			for _, sanction := range expired {
+				log.Printf("%s of %s expired", sanction.Kind, sanction.target())
+				action := ModUnban
+				if sanction.Kind == SanctionMute {
+					action = ModUnmute
+				}
+				h.recordAction(ModAction{
+					Actor:  sanctionExpiry,
+					Action: action,
+					Target: sanction.target(),
+					Detail: "imposed by " + sanction.By,
+				})
+				if sanction.Kind == SanctionMute && sanction.Username != "" {
+					h.notifyUser(sanction.Username, "Your mute has expired. You can send messages again.")
+				}
+			}
+		}
+	}()
+}
+
+// parseSanctionDuration reads a length like 30m, 2h, 7d or 2w.
+func parseSanctionDuration(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	if unit, ok := units[s[len(s)-1:]]; ok {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n <= 0 {
+			return 0, false
+		}
+		return time.Duration(n) * unit, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// parseSanctionArgs reads the optional length and the reason that follow
+// the target of /ban and /mute. No length means until lifted.
+func parseSanctionArgs(args []string) (*time.Time, string) {
+	if len(args) > 0 {
+		if d, ok := parseSanctionDuration(args[0]); ok {
+			expires := time.Now().Add(d)
+			return &expires, strings.Join(args[1:], " ")
+		}
+	}
+	return nil, strings.Join(args, " ")
+}
+
+// findSanctionTarget looks up the user named by an exact username or IPID.
+// Display names are not used: anyone could take another user's name as
+// theirs.
+func (h *Hub) findSanctionTarget(name string) (*model.User, bool) {
+	if user, ok := h.store.GetUser(name); ok {
+		return user, true
+	}
+	return h.store.FindUserByIPID(name)
+}
+
+// The widest address ranges a ban may cover, as prefix lengths, so one ban
+// can't shut out a whole provider or everyone.
+const (
+	minBanPrefixIPv4 = 16
+	minBanPrefixIPv6 = 32
+)
+
+// errNoSanctionTarget is returned by sanctionOf for a name that is neither
+// a user nor, for bans, an address.
+var errNoSanctionTarget = errors.New("user not found")
+
+// sanctionOf starts a sanction of kind against name: a user, or for bans
+// also an IP address or CIDR range. The user is nil for address bans.
+// Ranges that are too wide or that hold actorAddr, the address of whoever
+// is imposing it, are refused.
+func (h *Hub) sanctionOf(kind, name, actorAddr string) (Sanction, *model.User, error) {
+	if user, ok := h.findSanctionTarget(name); ok {
+		return Sanction{Kind: kind, Username: user.Username, IPID: user.IPID}, user, nil
+	}
+	if kind != SanctionBan {
+		return Sanction{}, nil, errNoSanctionTarget
+	}
+	sanction := Sanction{Kind: kind}
+	if _, network, err := net.ParseCIDR(name); err == nil {
+		ones, bits := network.Mask.Size()
+		floor := minBanPrefixIPv6
+		if network.IP.To4() != nil {
+			// Counted from the end, so IPv4-mapped IPv6 ranges get the
+			// same floor
+			floor = bits - 32 + minBanPrefixIPv4
+		}
+		if ones < floor {
+			return Sanction{}, nil, fmt.Errorf("range is wider than /%d", floor)
+		}
+		sanction.Addr = network.String()
+	} else if ip := net.ParseIP(name); ip != nil {
+		sanction.Addr = ip.String()
+	} else {
+		return Sanction{}, nil, errNoSanctionTarget
+	}
+	if sanction.matchesAddr(actorAddr) {
+		return Sanction{}, nil, errors.New("range holds your own address")
+	}
+	return sanction, nil, nil
+}
+
+// checkMuted tells the client and returns false if its user is muted.
+func (c *Client) checkMuted() bool {
+	if mute, ok := c.hub.bans.Active(SanctionMute, c.user); ok {
+		text := fmt.Sprintf("You are muted %s.", mute.until())
+		if mute.Reason != "" {
+			text = fmt.Sprintf("You are muted %s: %s", mute.until(), mute.Reason)
+		}
+		c.sendSystemMessage(text)
+		return false
+	}
+	return true
+}
+
+// handleSanction bans or mutes a user, or bans an address range:
+// /ban <user|ip_id|address[/bits]> [duration] [reason] and
+// /mute <user> [duration] [reason]
+func (c *Client) handleSanction(kind string, args []string) {
+	perm := PermBan
+	if kind == SanctionMute {
+		perm = PermMute
+	}
+	if !c.require(perm, "") {
+		return
+	}
+	if len(args) < 1 {
+		if kind == SanctionBan {
+			c.sendSystemMessage("Usage: /ban <user|ip_id|address[/bits]> [duration] [reason]")
+		} else {
+			c.sendSystemMessage("Usage: /mute <user> [duration] [reason]")
+		}
+		return
+	}
+	sanction, target, err := c.hub.sanctionOf(kind, args[0], c.addr)
+	if err == errNoSanctionTarget {
+		c.sendSystemMessage("User not found.")
+		return
+	}
+	if err != nil {
+		c.sendSystemMessage(fmt.Sprintf("Can't %s %s: %v.", kind, args[0], err))
+		return
+	}
+	if target != nil {
+		if target.Username == c.user.Username {
+			c.sendSystemMessage(fmt.Sprintf("You can't %s yourself.", kind))
+			return
+		}
+		mine := globalRole(c.user)
+		if mine != RoleOwner && atLeast(globalRole(target), mine) {
+			c.sendSystemMessage(fmt.Sprintf("Only someone ranked above %s can do that.", mine))
+			return
+		}
+	}
+
+	sanction.By = c.user.Username
+	sanction.Expires, sanction.Reason = parseSanctionArgs(args[1:])
+
+	sanction, err = c.hub.impose(sanction)
+	if err != nil {
+		c.sendSystemMessage(fmt.Sprintf("Failed to %s: %v", kind, err))
+		return
+	}
+	c.sendSystemMessage(fmt.Sprintf("%s %s (%s).", sanctionVerb(kind), sanction.target(), sanction.until()))
+}
+
+// impose puts a sanction in force and tells its target. Banned users
+// are disconnected and logged out everywhere; the addresses they were
+// connected from are kept to spot them coming back as someone else.
+func (h *Hub) impose(sanction Sanction) (Sanction, error) {
+	if sanction.Kind == SanctionBan && sanction.Username != "" {
+		sanction.SeenAddrs = h.addrsOf(sanction.Username)
+	}
+	sanction, err := h.bans.Add(sanction)
+	if err != nil {
+		return sanction, err
+	}
+	if sanction.Kind == SanctionBan {
+		h.disconnectBanned(sanction)
+		if sanction.Username != "" {
+			h.sessions.RevokeUser(sanction.Username)
+		}
+	} else {
+		text := fmt.Sprintf("You have been muted %s.", sanction.until())
+		if sanction.Reason != "" {
+			text = fmt.Sprintf("You have been muted %s: %s", sanction.until(), sanction.Reason)
+		}
+		h.notifyUser(sanction.Username, text)
+	}
+	log.Printf("%s %s %s %s: %q", sanction.By, strings.ToLower(sanctionVerb(sanction.Kind)), sanction.target(), sanction.until(), sanction.Reason)
+	action := ModBan
+	if sanction.Kind == SanctionMute {
+		action = ModMute
+	}
+	h.recordAction(ModAction{
+		Actor:  sanction.By,
+		Action: action,
+		Target: sanction.target(),
+		Reason: sanction.Reason,
+		Detail: sanction.until(),
+	})
+	return sanction, nil
+}
+
+// lift ends the sanctions of kind against name, a user, IPID or address
+// range, and tells a muted user they can speak again. It reports whether
+// there were any.
+func (h *Hub) lift(kind, name, by string) (bool, error) {
+	username, ipid, addr := "", name, name
+	if target, ok := h.findSanctionTarget(name); ok {
+		username, ipid, addr = target.Username, target.IPID, ""
+	} else if _, network, err := net.ParseCIDR(name); err == nil {
+		addr = network.String()
+	} else if ip := net.ParseIP(name); ip != nil {
+		addr = ip.String()
+	}
+	lifted, err := h.bans.Lift(kind, username, ipid, addr)
+	if err != nil || len(lifted) == 0 {
+		return false, err
+	}
+	if kind == SanctionMute && username != "" {
+		h.notifyUser(username, fmt.Sprintf("%s unmuted you.", by))
+	}
+	log.Printf("%s lifted the %s of %s", by, kind, lifted[0].target())
+	action := ModUnban
+	if kind == SanctionMute {
+		action = ModUnmute
+	}
+	h.recordAction(ModAction{Actor: by, Action: action, Target: lifted[0].target()})
+	return true, nil
+}
+
+// sanctionVerb is "Banned" or "Muted".
+func sanctionVerb(kind string) string {
+	if kind == SanctionBan {
+		return "Banned"
+	}
+	return "Muted"
+}
+
+// handleLiftSanction ends a ban or mute early:
+// /unban <user|ip_id|address[/bits]> and /unmute <user>
+func (c *Client) handleLiftSanction(kind string, args []string) {
+	perm := PermBan
+	if kind == SanctionMute {
+		perm = PermMute
+	}
+	if !c.require(perm, "") {
+		return
+	}
+	if len(args) != 1 {
+		if kind == SanctionBan {
+			c.sendSystemMessage("Usage: /unban <user|ip_id|address[/bits]>")
+		} else {
+			c.sendSystemMessage("Usage: /unmute <user>")
+		}
+		return
+	}
+	lifted, err := c.hub.lift(kind, args[0], c.user.Username)
+	if err != nil {
+		c.sendSystemMessage(fmt.Sprintf("Failed to un%s: %v", kind, err))
+		return
+	}
+	if !lifted {
+		c.sendSystemMessage(fmt.Sprintf("%s is not %s.", args[0], strings.ToLower(sanctionVerb(kind))))
+		return
+	}
+	c.sendSystemMessage(fmt.Sprintf("Lifted the %s of %s.", kind, args[0]))
+}
+
+// handleBanList shows the bans and mutes in force: /banlist
+func (c *Client) handleBanList(args []string) {
+	if !c.require(PermMute, "") {
+		return
+	}
+	list := c.hub.bans.List("")
+	if len(list) == 0 {
+		c.sendSystemMessage("Nobody is banned or muted.")
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("Bans and mutes:\n")
+	for _, s := range list {
+		sb.WriteString(fmt.Sprintf("• %s %s by %s on %s, %s", s.Kind, s.target(), s.By, s.Created.Format("2006-01-02 15:04"), s.until()))
+		if s.Reason != "" {
+			sb.WriteString(": " + s.Reason)
+		}
+		sb.WriteString("\n")
+	}
+	c.sendSystemMessage(sb.String())
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSanctionDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"30m", 30 * time.Minute, true},
+		{"2h", 2 * time.Hour, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"2w", 14 * 24 * time.Hour, true},
+		{"", 0, false},
+		{"d", 0, false},
+		{"0d", 0, false},
+		{"-1d", 0, false},
+		{"-5m", 0, false},
+		{"0s", 0, false},
+		{"1.5d", 0, false},
+		{"spam", 0, false},
+		{"10", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseSanctionDuration(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseSanctionDuration(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSanctionOf(t *testing.T) {
+	h := newTestHub(t)
+	addTestUser(h, "alice", "", "111.111.111.111")
+
+	tests := []struct {
+		name     string
+		kind     string
+		target   string
+		actor    string // Address of whoever imposes it
+		username string // User the sanction names
+		addr     string // Address or range the sanction names
+		ok       bool
+	}{
+		{"user by name", SanctionBan, "alice", "10.0.0.1", "alice", "", true},
+		{"user by IPID", SanctionMute, "111.111.111.111", "10.0.0.1", "alice", "", true},
+		{"display names don't count", SanctionBan, "Alice", "10.0.0.1", "", "", false},
+		{"mute of an address", SanctionMute, "192.0.2.7", "10.0.0.1", "", "", false},
+		{"IPv4 address", SanctionBan, "192.0.2.7", "10.0.0.1", "", "192.0.2.7", true},
+		{"IPv4 /24", SanctionBan, "192.0.2.99/24", "10.0.0.1", "", "192.0.2.0/24", true},
+		{"IPv4 /16", SanctionBan, "192.168.0.0/16", "10.0.0.1", "", "192.168.0.0/16", true},
+		{"IPv4 /15", SanctionBan, "192.168.0.0/15", "10.0.0.1", "", "", false},
+		{"IPv4 /0", SanctionBan, "0.0.0.0/0", "10.0.0.1", "", "", false},
+		{"IPv4-mapped /112", SanctionBan, "::ffff:192.168.0.0/112", "10.0.0.1", "", "192.168.0.0/16", true},
+		{"IPv4-mapped /111", SanctionBan, "::ffff:192.168.0.0/111", "10.0.0.1", "", "", false},
+		{"IPv6 /32", SanctionBan, "2001:db8::/32", "10.0.0.1", "", "2001:db8::/32", true},
+		{"IPv6 /31", SanctionBan, "2001:db8::/31", "10.0.0.1", "", "", false},
+		{"range holding the actor", SanctionBan, "10.0.0.0/24", "10.0.0.1", "", "", false},
+		{"actor's own address", SanctionBan, "10.0.0.1", "10.0.0.1", "", "", false},
+		{"nothing", SanctionBan, "nobody", "10.0.0.1", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sanction, user, err := h.sanctionOf(tt.kind, tt.target, tt.actor)
+			if (err == nil) != tt.ok {
+				t.Fatalf("sanctionOf(%q) error = %v, want ok %v", tt.target, err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			if sanction.Kind != tt.kind || sanction.Username != tt.username || sanction.Addr != tt.addr {
+				t.Errorf("sanctionOf(%q) = %+v, want user %q, addr %q", tt.target, sanction, tt.username, tt.addr)
+			}
+			if (user != nil) != (tt.username != "") {
+				t.Errorf("sanctionOf(%q) user = %v, want %q", tt.target, user, tt.username)
+			}
+		})
+	}
+}
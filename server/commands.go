@@ -1,10 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"slices"
 	"strings"
 	"time"
 
@@ -33,6 +34,8 @@ func (c *Client) handleCommand(cmdLine string) {
 		c.handleLogin(args)
 	case "/logout":
 		c.handleLogout()
+	case "/session":
+		c.handleSession(args)
 	case "/name":
 		c.handleName(args)
 	case "/help":
@@ -44,12 +47,42 @@ func (c *Client) handleCommand(cmdLine string) {
 	case "/kick":
 		c.handleKick(args)
 	case "/ban":
-		c.handleBan(args)
+		c.handleSanction(SanctionBan, args)
+	case "/unban":
+		c.handleLiftSanction(SanctionBan, args)
+	case "/mute":
+		c.handleSanction(SanctionMute, args)
+	case "/unmute":
+		c.handleLiftSanction(SanctionMute, args)
+	case "/banlist":
+		c.handleBanList(args)
+	case "/banreport":
+		c.handleBanReport(args)
+	case "/modlog":
+		c.handleModLog(args)
+	case "/filter":
+		c.handleFilter(args)
+	case "/role":
+		c.handleRole(args)
 	case "/join":
 		// Deprecated, alias to /room join
-		c.handleRoom([]string{"join", args[0]})
+		c.handleRoom(append([]string{"join"}, args...))
 	case "/room":
 		c.handleRoom(args)
+	case "/msg":
+		c.handleDirectMessage(args)
+	case "/reply":
+		c.handleReply(args)
+	case "/react":
+		c.handleReact(args)
+	case "/edit":
+		c.handleEdit(args)
+	case "/delete":
+		c.handleDelete(args)
+	case "/mentions":
+		c.handleMentions(args)
+	case "/away":
+		c.handleAway(args)
 	case "/member":
 		c.handleMember(args)
 	case "/userinfo":
@@ -63,7 +96,7 @@ func (c *Client) handleCommand(cmdLine string) {
 
 func (c *Client) handleRoom(args []string) {
 	if len(args) < 1 {
-		c.sendSystemMessage("Usage: /room <join|list|create|remove> ...")
+		c.sendSystemMessage("Usage: /room <join|leave|list|create|remove|rename|archive|restore|invite|kick|topic|info|set> ...")
 		return
 	}
 
@@ -76,67 +109,111 @@ func (c *Client) handleRoom(args []string) {
 
 	switch subCmd {
 	case "join":
-		if len(args) != 2 {
-			c.sendSystemMessage("Usage: /room join <room_name>")
+		if len(args) != 2 && len(args) != 3 {
+			c.sendSystemMessage("Usage: /room join <room_name> [password]")
 			return
 		}
 		roomName := args[1]
+		if !c.inRoom(roomName) && len(c.subscriptions()) >= maxSubscriptions {
+			c.sendSystemMessage(fmt.Sprintf("You can be in at most %d rooms. Leave one first with /room leave.", maxSubscriptions))
+			return
+		}
 
-		if !c.hub.config.RoomExists(roomName) {
+		room, ok := c.hub.rooms.Get(roomName)
+		if !ok {
 			c.sendSystemMessage("Room does not exist.")
 			return
 		}
-
-		oldRoom := c.Room
-		if oldRoom == "" {
-			oldRoom = "general"
+		if !c.hub.CanReadRoom(c.user, roomName) {
+			switch {
+			case room.Visibility == RoomInviteOnly:
+				c.sendSystemMessage("This room is invite-only.")
+				return
+			case room.PasswordHash == "":
+				// Private rooms are hidden from outsiders
+				c.sendSystemMessage("Room does not exist.")
+				return
+			case len(args) != 3:
+				c.sendSystemMessage("This room needs a password: /room join <room_name> <password>")
+				return
+			case !room.CheckPassword(args[2]):
+				c.sendSystemMessage("Incorrect room password.")
+				log.Printf("Failed room password for %s by %s", roomName, c.user.Username)
+				return
+			}
+			if _, err := c.hub.rooms.AddMember(roomName, c.user.Username); err != nil {
+				c.sendSystemMessage("Failed to join room: " + err.Error())
+				return
+			}
 		}
 
-		c.Room = roomName
-
-		event := model.Event{
-			Type: "room_join",
-			Payload: map[string]string{
-				"room": roomName,
-			},
-		}
-		bytes, _ := json.Marshal(event)
-		c.send <- bytes
+		c.joinRoom(roomName)
 
 		c.sendSystemMessage(fmt.Sprintf("Joined room: %s", roomName))
-		log.Printf("User %s moved from %s to %s", c.user.Username, oldRoom, roomName)
+		log.Printf("User %s joined %s", c.user.Username, roomName)
 
-	case "list":
-		c.hub.config.mu.RLock()
-		rooms := c.hub.config.Rooms
-		c.hub.config.mu.RUnlock()
+	case "leave":
+		c.handleRoomLeave(args[1:])
 
+	case "list":
 		var sb strings.Builder
 		sb.WriteString("Available Rooms:\n")
-		for _, r := range rooms {
-			sb.WriteString(fmt.Sprintf("• %s\n", r))
+		joined := make(map[string]bool)
+		for _, name := range c.subscriptions() {
+			joined[name] = true
+		}
+		for _, r := range c.hub.rooms.List() {
+			if !r.Listed() && !c.hub.CanReadRoom(c.user, r.Name) {
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("• %s", r.Name))
+			if r.Visibility != RoomPublic {
+				sb.WriteString(" (" + r.Visibility + ")")
+			}
+			if r.PasswordHash != "" {
+				sb.WriteString(" 🔒")
+			}
+			if r.Archived {
+				sb.WriteString(" [archived]")
+			}
+			if r.Name == c.roomName() {
+				sb.WriteString(" (active)")
+			} else if joined[r.Name] {
+				sb.WriteString(" (joined)")
+			}
+			sb.WriteString("\n")
 		}
 		c.sendSystemMessage(sb.String())
 
 	case "create":
-		if !c.isAdmin {
-			c.sendSystemMessage("Admin only.")
+		if !c.require(PermRoomCreate, "") {
 			return
 		}
-		if len(args) != 2 {
-			c.sendSystemMessage("Usage: /room create <room_name>")
+		if len(args) < 2 || len(args) > 4 {
+			c.sendSystemMessage("Usage: /room create <room_name> [public|private|invite-only] [password]")
 			return
 		}
 		roomName := args[1]
-		if len(roomName) > 20 {
-			c.sendSystemMessage("Room name too long.")
+		if !c.checkRoomName(roomName) {
+			return
+		}
+		visibility := RoomPublic
+		if len(args) > 2 {
+			visibility = args[2]
+		}
+		if !validVisibility(visibility) {
+			c.sendSystemMessage("Visibility must be public, private or invite-only.")
 			return
 		}
-		if c.hub.config.RoomExists(roomName) {
+		password := ""
+		if len(args) > 3 {
+			password = args[3]
+		}
+		if c.hub.rooms.Exists(roomName) {
 			c.sendSystemMessage("Room already exists.")
 			return
 		}
-		if err := c.hub.config.AddRoom(roomName); err != nil {
+		if err := c.hub.rooms.Create(roomName, c.user.Username, visibility, password); err != nil {
 			c.sendSystemMessage("Failed to create room: " + err.Error())
 			return
 		}
@@ -151,53 +228,309 @@ func (c *Client) handleRoom(args []string) {
 		}
 		c.hub.store.AddMessage(welcomeMsg)
 
-		c.sendSystemMessage(fmt.Sprintf("Room %s created.", roomName))
+		c.recordAction(ModRoomCreate, roomName, "", "", visibility)
+		c.sendSystemMessage(fmt.Sprintf("Room %s created (%s).", roomName, visibility))
+
+	case "invite":
+		c.handleRoomInvite(args[1:])
+
+	case "kick":
+		c.handleRoomKick(args[1:])
+
+	case "topic":
+		c.handleRoomTopic(args[1:])
+
+	case "info":
+		c.handleRoomInfo(args[1:])
+
+	case "set":
+		c.handleRoomSet(args[1:])
 
 	case "remove":
-		if !c.isAdmin {
-			c.sendSystemMessage("Admin only.")
-			return
+		c.handleRoomRemove(args[1:])
+
+	case "rename":
+		c.handleRoomRename(args[1:])
+
+	case "archive":
+		c.handleRoomArchive(args[1:], true)
+
+	case "restore":
+		c.handleRoomArchive(args[1:], false)
+
+	default:
+		c.sendSystemMessage("Unknown subcommand.")
+	}
+}
+
+// maxDirectMessageLength is how many characters a direct message may have.
+// It stays under maxMessageSize, which also holds the event around it.
+const maxDirectMessageLength = 400
+
+func (c *Client) handleDirectMessage(args []string) {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
+		return
+	}
+	if len(args) < 2 {
+		c.sendSystemMessage("Usage: /msg <user> <text>")
+		return
+	}
+
+	// By username only: display names can be chosen to look like someone
+	// else's
+	target, ok := c.hub.store.GetUser(args[0])
+	if !ok {
+		c.sendSystemMessage("User not found.")
+		return
+	}
+	if target.Username == c.user.Username {
+		c.sendSystemMessage("You cannot message yourself.")
+		return
+	}
+
+	msg := c.newMessage(strings.Join(args[1:], " "))
+	msg.Recipient = target.Username
+	c.postDirectMessage(msg)
+}
+
+// postDirectMessage stores a direct message and delivers it to both sides.
+// It goes through the same checks as a room message, with the filter rules
+// for every room.
+func (c *Client) postDirectMessage(msg model.Message) {
+	if !c.require(PermPost, "") || !c.checkMuted() || !c.checkMessageLength("", msg.Content) {
+		return
+	}
+	filtered, ok := c.filterMessage("", msg.Content)
+	c.hub.filters.Remember(c.user.Username, "", msg.Content)
+	if !ok {
+		return
+	}
+	msg.Content = filtered.content
+
+	msg, err := c.hub.store.AddDirectMessage(msg)
+	if err != nil {
+		log.Printf("Failed to store direct message from %s: %v", c.user.Username, err)
+		c.sendSystemMessage("Failed to send message.")
+		return
+	}
+
+	// Both sides see it, on every connection they have open
+	c.hub.publishMessageEvent(model.EventDirectMessage, msg, nil)
+	log.Printf("Direct message from %s to %s", c.user.Username, msg.Recipient)
+	if len(filtered.flagged) > 0 {
+		c.hub.flagMessage(msg, filtered.flagged)
+	}
+}
+
+func (c *Client) handleReply(args []string) {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
+		return
+	}
+	if len(args) < 2 {
+		c.sendSystemMessage("Usage: /reply <message_id> <text>")
+		return
+	}
+
+	id, err := c.hub.store.ResolveMessageID(args[0])
+	if err != nil {
+		c.sendSystemMessage(err.Error())
+		return
+	}
+	parent, ok := c.hub.store.GetMessage(id)
+	if !ok || !c.hub.CanReadMessage(c.user, parent) {
+		c.sendSystemMessage("message not found")
+		return
+	}
+
+	msg := c.newMessage(strings.Join(args[1:], " "))
+	msg.ReplyTo = parent.ID
+
+	// A reply goes to the conversation of the message it answers
+	if parent.Recipient != "" {
+		msg.Recipient = parent.Recipient
+		if parent.Recipient == c.user.Username {
+			msg.Recipient = parent.Sender
 		}
-		if len(args) != 2 {
-			c.sendSystemMessage("Usage: /room remove <room_name>")
+		c.postDirectMessage(msg)
+		return
+	}
+
+	room := c.roomName()
+	if parent.Room != room {
+		c.sendSystemMessage(fmt.Sprintf("That message is in room %s. Join it to reply.", parent.Room))
+		return
+	}
+	msg.Room = room
+	c.postMessage(msg)
+}
+
+func (c *Client) handleReact(args []string) {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
+		return
+	}
+	if len(args) != 2 {
+		c.sendSystemMessage("Usage: /react <message_id> <emoji|:shortcode:>")
+		return
+	}
+
+	emoji, err := parseReaction(args[1])
+	if err != nil {
+		c.sendSystemMessage(err.Error())
+		return
+	}
+	id, err := c.hub.store.ResolveMessageID(args[0])
+	if err != nil {
+		c.sendSystemMessage(err.Error())
+		return
+	}
+	msg, ok := c.hub.store.GetMessage(id)
+	if !ok || !c.hub.CanReadMessage(c.user, msg) {
+		c.sendSystemMessage("message not found")
+		return
+	}
+	if msg.Room != "" && !c.checkWritable(msg.Room) {
+		return
+	}
+
+	msg, err = c.hub.store.ToggleReaction(id, emoji, c.user.Username)
+	if err != nil {
+		c.sendSystemMessage("Failed to react: " + err.Error())
+		return
+	}
+	c.hub.publishMessageEvent(model.EventReactionUpdate, msg, model.ReactionPayload{
+		MessageID: msg.ID,
+		Room:      msg.Room,
+		Reactions: msg.Reactions,
+	})
+}
+
+// errNotYours stops an edit or delete of someone else's message.
+var errNotYours = errors.New("not your message")
+
+func (c *Client) handleEdit(args []string) {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
+		return
+	}
+	if len(args) < 2 {
+		c.sendSystemMessage("Usage: /edit <message_id> <new text>")
+		return
+	}
+
+	id, err := c.hub.store.ResolveMessageID(args[0])
+	if err != nil {
+		c.sendSystemMessage(err.Error())
+		return
+	}
+	content := strings.Join(args[1:], " ")
+	var mentions, mentionedBefore []string
+	var flagged []FilterRule
+	if old, ok := c.hub.store.GetMessage(id); ok {
+		mentionedBefore = old.Mentions
+		// Direct messages have no room, and go by the rules for every room
+		if !c.require(PermPost, old.Room) || !c.checkMuted() || (old.Room != "" && !c.checkWritable(old.Room)) || !c.checkMessageLength(old.Room, content) {
 			return
 		}
-		roomName := args[1]
-		if roomName == "general" {
-			c.sendSystemMessage("Cannot remove general room.")
+		filtered, ok := c.filterMessage(old.Room, content)
+		if !ok {
 			return
 		}
-		if !c.hub.config.RoomExists(roomName) {
-			c.sendSystemMessage("Room does not exist.")
-			return
+		content, flagged = filtered.content, filtered.flagged
+		if old.Room != "" {
+			mentions = c.hub.findMentions(content, old.Room, c.user.Username)
 		}
-		if err := c.hub.config.RemoveRoom(roomName); err != nil {
-			c.sendSystemMessage("Failed to remove room: " + err.Error())
-			return
+	}
+	msg, err := c.hub.store.UpdateMessage(id, func(msg *model.Message) error {
+		if msg.Sender != c.user.Username {
+			return errNotYours
 		}
-		// Move users in that room to general?
-		// For now, just let them be in a ghost room until they move.
-		// Or we can iterate clients and move them.
-		// Iterating is better UX.
-		for client := range c.hub.clients {
-			if client.Room == roomName {
-				client.Room = "general"
-				event := model.Event{
-					Type: "room_join",
-					Payload: map[string]string{
-						"room": "general",
-					},
-				}
-				bytes, _ := json.Marshal(event)
-				client.send <- bytes
-				client.sendSystemMessage("Room was removed. Moved to general.")
-			}
+		if msg.Deleted {
+			return errors.New("message was deleted")
+		}
+		now := time.Now()
+		msg.Content = content
+		msg.Mentions = mentions
+		msg.EditedAt = &now
+		return nil
+	})
+	if err == errNotYours {
+		c.sendSystemMessage("You can only edit your own messages.")
+		return
+	}
+	if err != nil {
+		c.sendSystemMessage("Failed to edit message: " + err.Error())
+		return
+	}
+
+	log.Printf("Message %s edited by %s", msg.ID, c.user.Username)
+	c.hub.publishMessageEvent(model.EventMessageEdited, msg, nil)
+	// Only users the edit newly mentions are notified
+	notify := msg
+	notify.Mentions = nil
+	for _, username := range msg.Mentions {
+		if !slices.Contains(mentionedBefore, username) {
+			notify.Mentions = append(notify.Mentions, username)
 		}
-		c.sendSystemMessage(fmt.Sprintf("Room %s removed.", roomName))
+	}
+	c.hub.notifyMentions(notify)
+	if len(flagged) > 0 {
+		c.hub.flagMessage(msg, flagged)
+	}
+}
 
-	default:
-		c.sendSystemMessage("Unknown subcommand.")
+func (c *Client) handleDelete(args []string) {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
+		return
+	}
+	if len(args) < 1 {
+		c.sendSystemMessage("Usage: /delete <message_id>")
+		return
+	}
+
+	id, err := c.hub.store.ResolveMessageID(args[0])
+	if err != nil {
+		c.sendSystemMessage(err.Error())
+		return
+	}
+	old, ok := c.hub.store.GetMessage(id)
+	if !ok || !c.hub.CanReadMessage(c.user, old) {
+		c.sendSystemMessage("message not found")
+		return
+	}
+	if old.Room != "" && !c.checkWritable(old.Room) {
+		return
+	}
+	msg, err := c.hub.store.UpdateMessage(id, func(msg *model.Message) error {
+		if msg.Sender != c.user.Username && !c.can(PermDeleteAny, msg.Room) {
+			return errNotYours
+		}
+		if msg.Deleted {
+			return errors.New("message was already deleted")
+		}
+		// Keep the tombstone so replies and history stay in order
+		msg.Content = ""
+		msg.Deleted = true
+		msg.DeletedBy = c.user.Username
+		return nil
+	})
+	if err == errNotYours {
+		c.sendSystemMessage("You can only delete your own messages.")
+		return
+	}
+	if err != nil {
+		c.sendSystemMessage("Failed to delete message: " + err.Error())
+		return
 	}
+
+	log.Printf("Message %s by %s deleted by %s", msg.ID, msg.Sender, c.user.Username)
+	if msg.Sender != c.user.Username {
+		c.recordAction(ModDeleteMessage, msg.Sender, msg.Room, "", "message "+msg.ID)
+	}
+	c.hub.publishMessageEvent(model.EventMessageDeleted, msg, nil)
 }
 
 func (c *Client) handleRegister(args []string) {
@@ -207,6 +540,9 @@ func (c *Client) handleRegister(args []string) {
 	}
 	username := args[0]
 	password := args[1]
+	if c.refuseBanned(nil, stageRegister) || !c.checkLoginRate("") {
+		return
+	}
 
 	// Generate random IPID
 	ipid := generateIPID()
@@ -216,9 +552,9 @@ func (c *Client) handleRegister(args []string) {
 		c.sendSystemMessage("Registration failed: " + err.Error())
 		return
 	}
+	c.refuseBanned(user, stageRegister) // Only notes a suspected evasion
 
-	c.user = user
-	c.isAdmin = user.IsAdmin
+	c.startSession(user)
 	c.sendSystemMessage(fmt.Sprintf("Registered and logged in as %s (%s)", user.Username, user.IPID))
 	c.SendHistory()
 	log.Printf("User registered: %s (%s)", user.Username, user.IPID)
@@ -231,6 +567,9 @@ func (c *Client) handleLogin(args []string) {
 	}
 	username := args[0]
 	password := args[1]
+	if !c.checkLoginRate(username) {
+		return
+	}
 
 	user, err := c.hub.store.Authenticate(username, password)
 	if err != nil {
@@ -238,24 +577,152 @@ func (c *Client) handleLogin(args []string) {
 		log.Printf("Login failed for %s: %v", username, err)
 		return
 	}
+	if c.refuseBanned(user, stageLogin) {
+		return
+	}
 
-	c.user = user
-	c.isAdmin = user.IsAdmin
+	c.startSession(user)
 	c.sendSystemMessage(fmt.Sprintf("Logged in as %s (%s)", user.Username, user.IPID))
 	log.Printf("Calling SendHistory for user: %s", user.Username)
 	c.SendHistory()
 	log.Printf("User logged in: %s (%s)", user.Username, user.IPID)
 }
 
+// startSession logs the connection in as user and issues a session token
+// the client can use for the REST API and to resume the login later.
+func (c *Client) startSession(user *model.User) {
+	c.hub.leaveRoom(c)
+	c.user = user
+	c.hub.dropRooms(c)
+	defer c.hub.enterRoom(c)
+
+	sess, err := c.hub.sessions.Issue(user.Username)
+	if err != nil {
+		log.Printf("Failed to issue session for %s: %v", user.Username, err)
+		c.session = nil
+		return
+	}
+	c.session = sess
+	c.sendSession(sess.Token)
+	c.sendUnread()
+	c.sendMentionCount()
+	c.sendRoomUpdate()
+}
+
+// resumeSession logs the connection in with a token saved by the client.
+func (c *Client) resumeSession(token string) bool {
+	sess, ok := c.hub.sessions.Lookup(token)
+	var user *model.User
+	if ok {
+		user, ok = c.hub.store.GetUser(sess.Username)
+	}
+	if !ok {
+		c.sendError(model.ErrSessionInvalid, "Your saved session has expired. Please /login again.")
+		return true
+	}
+	if c.refuseBanned(user, stageSession) {
+		return false
+	}
+
+	c.user = user
+	c.session = sess
+	c.sendSession(token)
+	c.sendUnread()
+	c.sendSystemMessage(fmt.Sprintf("Resumed session as %s (%s)", user.Username, user.IPID))
+	c.sendMentionCount()
+	log.Printf("User resumed session: %s (%s)", user.Username, sess.ID)
+	return true
+}
+
+// sendSession tells the client which token to keep. An empty token makes
+// the client forget the one it saved.
+func (c *Client) sendSession(token string) {
+	payload := model.SessionPayload{Token: token}
+	if c.session != nil && token != "" {
+		payload.Username = c.session.Username
+		payload.Expires = c.session.Expires
+	}
+	c.sendEvent(model.EventSession, payload)
+}
+
 func (c *Client) handleLogout() {
 	if c.user != nil {
 		log.Printf("User logged out: %s", c.user.Username)
 	}
+	if c.session != nil {
+		c.hub.sessions.Revoke(c.session.ID, "")
+		c.session = nil
+	}
+	c.hub.leaveRoom(c)
 	c.user = nil
-	c.isAdmin = false
+	c.hub.dropRooms(c)
+	c.sendSession("")
 	c.sendSystemMessage("Logged out.")
 }
 
+func (c *Client) handleSession(args []string) {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
+		return
+	}
+	if len(args) < 1 {
+		c.sendSystemMessage("Usage: /session <list|revoke> ...")
+		return
+	}
+
+	switch args[0] {
+	case "list":
+		sessions := c.hub.sessions.List(c.user.Username)
+		var sb strings.Builder
+		sb.WriteString("Active Sessions:\n")
+		for _, sess := range sessions {
+			current := ""
+			if c.session != nil && c.session.ID == sess.ID {
+				current = " (this connection)"
+			}
+			sb.WriteString(fmt.Sprintf("• %s - created %s, last seen %s, expires %s%s\n",
+				sess.ID,
+				sess.Created.Format("2006-01-02 15:04"),
+				sess.LastSeen.Format("2006-01-02 15:04"),
+				sess.Expires.Format("2006-01-02 15:04"),
+				current))
+		}
+		if len(sessions) == 0 {
+			sb.WriteString("No active sessions.\n")
+		}
+		c.sendSystemMessage(sb.String())
+
+	case "revoke":
+		if len(args) != 2 {
+			c.sendSystemMessage("Usage: /session revoke <id|all>")
+			return
+		}
+		if args[1] == "all" {
+			revoked := c.hub.sessions.RevokeUser(c.user.Username)
+			c.hub.EndSessions(revoked, c)
+			c.sendSystemMessage(fmt.Sprintf("Revoked %d session(s). Log in again to get a new one.", len(revoked)))
+			return
+		}
+		sess, ok := c.hub.sessions.Revoke(args[1], c.user.Username)
+		if !ok {
+			c.sendSystemMessage("Session not found.")
+			return
+		}
+		c.hub.EndSessions([]*Session{sess}, c)
+		c.sendSystemMessage(fmt.Sprintf("Session %s revoked.", sess.ID))
+
+	default:
+		c.sendSystemMessage("Unknown subcommand.")
+	}
+}
+
+func (c *Client) sendError(code, text string) {
+	c.sendEvent(model.EventError, model.ErrorPayload{
+		Code:    code,
+		Message: text,
+	})
+}
+
 func (c *Client) handleName(args []string) {
 	if c.user == nil {
 		c.sendSystemMessage("You must be logged in to change name.")
@@ -289,41 +756,97 @@ func (c *Client) handleHelp() {
 /register <user> <pass> - Register new account
 /login <user> <pass> - Login
 /logout - Logout
+/session <list|revoke> ... - Manage your login sessions
 /help - Show this help
 /room <join|list|create|remove> ... - Manage rooms
+/room leave [room] - Leave a room, staying in the others
+/room rename <room> <new_name> - Rename a room, keeping its history
+/room archive <room> - Make a room read-only
+/room restore <room> - Reopen an archived room
+/room invite <room> <user> - Let a user into your room
+/room kick <room> <user> - Remove a user from your room
+/room topic [text|-] - Show or set the room topic
+/room info [room] - Show room details and settings
+/room set <setting> <value> - Change a room setting
+/msg <user> <text> - Send a private message
+/reply <id> <text> - Reply to a message
+/react <id> <emoji> - Toggle a reaction (e.g. :+1:, :tada:)
+/edit <id> <text> - Edit one of your messages
+/delete <id> - Delete one of your messages
+/mentions - Read mentions you missed
+/away [message] - Mark yourself away, or back
 /member list [room] - List members
 /userinfo <name> - Show user info
 /server info - Show server info
 /admin <pass> - Become admin
-/clan <create|add|remove> ... - Manage clans (admin only)
-/kick <ip_id> - Kick a user (admin only)
-/ban <ip_id> - Ban a user (admin only)
+/role list [room] - Show who has which role
+/role set <user> <role> [room] - Give a role, server-wide or in a room
+/role clear <user> [room] - Take a role away
+/role perms [role] - Show what each role may do
+/role history [user] - Show who changed whose role (role.manage)
+/clan <create|add|remove> ... - Manage clans (clan.manage)
+/kick <ip_id> - Kick a user (kick)
+/ban <user|ip_id|address[/bits]> [duration] [reason] - Ban a user or address, e.g. 2h or 7d (ban)
+/unban <user|ip_id|address[/bits]> - Lift a ban (ban)
+/mute <user> [duration] [reason] - Stop a user sending (mute)
+/unmute <user> - Lift a mute (mute)
+/banlist - Show bans and mutes (mute)
+/banreport [count] - Show attempts to get around bans (ban)
+/modlog [user|action] [count] - Show moderation actions (modlog.read)
+/filter list - Show the message filter rules (filter.manage)
+/filter add <block|link|caps|repeat> <reject|mask|flag> <room|*> [pattern] - Add a filter rule
+/filter remove <id> - Remove a filter rule
 `
 	c.sendSystemMessage(help)
 }
 
+// handleAdmin makes the logged-in account an admin if the admin password
+// is right. Wrong passwords are rate limited, and the grant is recorded.
 func (c *Client) handleAdmin(args []string) {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
+		return
+	}
 	if len(args) != 1 {
 		c.sendSystemMessage("Usage: /admin <password>")
 		return
 	}
-	if args[0] == c.hub.config.AdminPassword {
-		c.isAdmin = true
-		if c.user != nil {
-			c.user.IsAdmin = true
-			c.hub.store.SaveUsers()
+	if atLeast(globalRole(c.user), RoleAdmin) {
+		c.sendSystemMessage(fmt.Sprintf("You are already %s.", globalRole(c.user)))
+		return
+	}
+	if !c.hub.config.HasAdminPassword() {
+		c.sendSystemMessage("Admin password login is disabled on this server.")
+		return
+	}
+	username := c.user.Username
+	if wait := c.hub.attempts.Wait(username, c.addr); wait > 0 {
+		c.sendSystemMessage(fmt.Sprintf("Too many failed attempts. Try again in %s.", wait.Round(time.Second)))
+		return
+	}
+	if !c.hub.config.CheckAdminPassword(args[0]) {
+		wait := c.hub.attempts.Miss(username, c.addr)
+		log.Printf("Failed admin attempt by %s from %s", username, c.addr)
+		if wait > 0 {
+			c.sendSystemMessage(fmt.Sprintf("Incorrect password. Try again in %s.", wait.Round(time.Second)))
+		} else {
+			c.sendSystemMessage("Incorrect password.")
 		}
-		c.sendSystemMessage("You are now an admin.")
-		log.Printf("User became admin: %s", c.user.Username)
-	} else {
-		c.sendSystemMessage("Incorrect password.")
-		log.Printf("Failed admin attempt by %s", c.user.Username)
+		return
 	}
+	c.hub.attempts.Reset(username, c.addr)
+
+	if err := c.hub.store.SetRole(username, RoleAdmin); err != nil {
+		c.sendSystemMessage("Failed to set role: " + err.Error())
+		return
+	}
+	c.hub.recordGrant(Grant{Username: username, Role: RoleAdmin, By: grantByPassword, Addr: c.addr})
+	c.sendSystemMessage("You are now an admin.")
+	log.Printf("User became admin: %s from %s", username, c.addr)
 }
 
 func (c *Client) handleClan(args []string) {
-	if !c.isAdmin {
-		c.sendSystemMessage("Admin only.")
+	if !c.require(PermClanManage, "") {
 		return
 	}
 	if len(args) < 1 {
@@ -354,6 +877,7 @@ func (c *Client) handleClan(args []string) {
 			return
 		}
 		c.hub.config.SetClan(tag, color)
+		c.recordAction(ModClanCreate, tag, "", "", color)
 		c.sendSystemMessage(fmt.Sprintf("Clan %s created with color %s.", tag, color))
 
 	case "add":
@@ -399,6 +923,7 @@ func (c *Client) handleClan(args []string) {
 		if !found {
 			targetUser.Clans = append(targetUser.Clans, tag)
 			c.hub.store.SaveUsers()
+			c.recordAction(ModClanAdd, targetUser.Username, "", "", "clan "+tag)
 			c.sendSystemMessage(fmt.Sprintf("Added %s to clan %s.", targetUser.Username, tag))
 		} else {
 			c.sendSystemMessage("User already in clan.")
@@ -433,6 +958,7 @@ func (c *Client) handleClan(args []string) {
 		}
 		targetUser.Clans = newClans
 		c.hub.store.SaveUsers()
+		c.recordAction(ModClanRemove, targetUser.Username, "", "", "clan "+tag)
 		c.sendSystemMessage(fmt.Sprintf("Removed %s from clan %s.", targetUser.Username, tag))
 
 	case "list":
@@ -468,51 +994,33 @@ func (c *Client) handleClan(args []string) {
 }
 
 func (c *Client) handleKick(args []string) {
-	if !c.isAdmin {
-		c.sendSystemMessage("Admin only.")
+	if !c.require(PermKick, "") {
 		return
 	}
 	if len(args) != 1 {
 		c.sendSystemMessage("Usage: /kick <ip_id>")
 		return
 	}
-	targetIPID := args[0]
-
-	// Find client with this IPID
-	for client := range c.hub.clients {
-		if client.user != nil && client.user.IPID == targetIPID {
-			client.sendSystemMessage("You have been kicked.")
-			client.conn.Close()
-			delete(c.hub.clients, client)
-			c.sendSystemMessage("User kicked.")
-			return
-		}
+	if !c.hub.KickUser(args[0], c.user.Username, c.addr) {
+		c.sendSystemMessage("User not active.")
+		return
 	}
-	c.sendSystemMessage("User not active.")
+	c.sendSystemMessage("User kicked.")
 }
 
-func (c *Client) handleBan(args []string) {
-	if !c.isAdmin {
-		c.sendSystemMessage("Admin only.")
+func (c *Client) handleAway(args []string) {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
 		return
 	}
-	if len(args) != 1 {
-		c.sendSystemMessage("Usage: /ban <ip_id>")
+	if len(args) == 0 && c.away {
+		c.hub.setAway(c, false, "")
+		c.sendSystemMessage("You are back.")
 		return
 	}
-	targetIPID := args[0]
-
-	c.hub.config.Ban(targetIPID)
-
-	// Kick if active
-	for client := range c.hub.clients {
-		if client.user != nil && client.user.IPID == targetIPID {
-			client.sendSystemMessage("You have been banned.")
-			client.conn.Close()
-			delete(c.hub.clients, client)
-		}
-	}
-	c.sendSystemMessage("User banned.")
+	message := strings.Join(args, " ")
+	c.hub.setAway(c, true, message)
+	c.sendSystemMessage("You are marked as away. Use /away again to come back.")
 }
 
 func (c *Client) handleMember(args []string) {
@@ -535,19 +1043,29 @@ func (c *Client) handleMember(args []string) {
 	}
 
 	count := 0
+	c.hub.mu.Lock()
 	for client := range c.hub.clients {
 		if client.user != nil {
-			if targetRoom != "" && client.Room != targetRoom {
+			if targetRoom != "" && !client.subs[targetRoom] {
 				continue
 			}
-			room := client.Room
-			if room == "" {
-				room = "general"
+			// Don't reveal who is in rooms the caller can't see
+			visible := c.hub.CanReadRoom(c.user, client.roomNameInternal())
+			if targetRoom != "" && !c.hub.CanReadRoom(c.user, targetRoom) {
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("• %s (%s)", client.user.Username, client.user.DisplayName))
+			if visible {
+				sb.WriteString(fmt.Sprintf(" [Room: %s]", client.roomNameInternal()))
+			}
+			if status := client.presenceStatus(); status != "" {
+				sb.WriteString(" (" + status + ")")
 			}
-			sb.WriteString(fmt.Sprintf("• %s (%s) [Room: %s]\n", client.user.Username, client.user.DisplayName, room))
+			sb.WriteString("\n")
 			count++
 		}
 	}
+	c.hub.mu.Unlock()
 	if count == 0 {
 		sb.WriteString("No members found.\n")
 	}
@@ -580,16 +1098,19 @@ func (c *Client) handleUserInfo(args []string) {
 	// Check online status
 	isOnline := false
 	currentRoom := "Offline"
+	c.hub.mu.Lock()
 	for client := range c.hub.clients {
 		if client.user != nil && client.user.Username == targetUser.Username {
 			isOnline = true
-			currentRoom = client.Room
-			if currentRoom == "" {
-				currentRoom = "general"
+			currentRoom = client.roomNameInternal()
+			// Don't reveal who is in rooms the caller can't see
+			if !c.hub.CanReadRoom(c.user, currentRoom) {
+				currentRoom = "Hidden"
 			}
 			break
 		}
 	}
+	c.hub.mu.Unlock()
 
 	status := "Offline"
 	if isOnline {
@@ -603,14 +1124,14 @@ func (c *Client) handleUserInfo(args []string) {
 			"• Status: %s\n"+
 			"• Room: %s\n"+
 			"• IPID: %s\n"+
-			"• Admin: %v\n"+
+			"• Role: %s\n"+
 			"• Clans: %v\n",
 		targetUser.Username,
 		targetUser.DisplayName,
 		status,
 		currentRoom,
 		targetUser.IPID,
-		targetUser.IsAdmin,
+		globalRole(targetUser),
 		targetUser.Clans,
 	)
 	c.sendSystemMessage(info)
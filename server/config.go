@@ -2,22 +2,31 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"os"
 	"sync"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Config struct {
-	AdminPassword   string            `json:"admin_password"`
+	AdminPassword   string            `json:"admin_password,omitempty"` // Deprecated: hashed into AdminPasswordHash on load
 	Port            string            `json:"port"`
 	Host            string            `json:"host"`
 	WelcomeMessage  string            `json:"welcome_message"`
-	BannedIPIDs     []string          `json:"banned_ip_ids"`
-	Clans           map[string]string `json:"clans"` // Tag -> HexColor
+	BannedIPIDs     []string          `json:"banned_ip_ids,omitempty"` // Deprecated: moved to bans.json on first start
+	Clans           map[string]string `json:"clans"`                   // Tag -> HexColor
 	AdminIPIDSuffix string            `json:"admin_ipid_suffix"`
 	ServerName      string            `json:"server_name"`
-	Rooms           []string          `json:"rooms"`
-	mu              sync.RWMutex
-	configFile      string
+	Rooms           []string          `json:"rooms,omitempty"` // Deprecated: moved to rooms.json on first start
+	SessionTTLHours int               `json:"session_ttl_hours"`
+
+	AdminPasswordHash string `json:"admin_password_hash"` // bcrypt; empty disables /admin
+
+	RateLimits RateLimits `json:"rate_limits"`
+
+	mu         sync.RWMutex
+	configFile string
 }
 
 func NewConfig(filename string) *Config {
@@ -29,13 +38,12 @@ func NewConfig(filename string) *Config {
 		// Defaults
 		Port:            "8999",
 		Host:            "localhost",
-		AdminPassword:   "admin",
 		WelcomeMessage:  "Welcome to CMPPChat! Type /help for commands.",
-		BannedIPIDs:     []string{},
 		Clans:           make(map[string]string),
 		AdminIPIDSuffix: "1",
 		ServerName:      "CMPPChat Server",
-		Rooms:           []string{"general"},
+		SessionTTLHours: 24 * 7,
+		RateLimits:      defaultRateLimits,
 	}
 }
 
@@ -56,6 +64,18 @@ func (c *Config) Load() error {
 		return err
 	}
 
+	// Older configs kept the admin password in plain text
+	if c.AdminPassword != "" {
+		if err := checkAdminPassword(c.AdminPassword); err != nil {
+			log.Printf("admin_password in %s is too weak (%v) and was removed; run ./server init to set a new one", c.configFile, err)
+		} else if hash, err := bcrypt.GenerateFromPassword([]byte(c.AdminPassword), bcrypt.DefaultCost); err == nil {
+			c.AdminPasswordHash = string(hash)
+		} else {
+			return err
+		}
+		c.AdminPassword = ""
+	}
+
 	// Auto-update config file with any missing fields (defaults)
 	return c.saveInternal()
 }
@@ -74,43 +94,45 @@ func (c *Config) saveInternal() error {
 	return os.WriteFile(c.configFile, data, 0644)
 }
 
-func (c *Config) IsBanned(ipid string) bool {
+// Limits returns the flood limits.
+func (c *Config) Limits() RateLimits {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	for _, banned := range c.BannedIPIDs {
-		if banned == ipid {
-			return true
-		}
-	}
-	return false
+	return c.RateLimits
 }
 
-func (c *Config) Ban(ipid string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// HasAdminPassword reports whether an admin password has been set.
+func (c *Config) HasAdminPassword() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.AdminPasswordHash != ""
+}
 
-	// Check if already banned
-	for _, banned := range c.BannedIPIDs {
-		if banned == ipid {
-			return nil
-		}
+// CheckAdminPassword reports whether password is the admin password.
+func (c *Config) CheckAdminPassword(password string) bool {
+	c.mu.RLock()
+	hash := c.AdminPasswordHash
+	c.mu.RUnlock()
+	if hash == "" {
+		return false
 	}
-
-	c.BannedIPIDs = append(c.BannedIPIDs, ipid)
-	return c.saveInternal()
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
-func (c *Config) Unban(ipid string) error {
+// SetAdminPassword stores a hash of password as the admin password. The
+// password must pass checkAdminPassword.
+func (c *Config) SetAdminPassword(password string) error {
+	if err := checkAdminPassword(password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
-
-	newBanned := []string{}
-	for _, banned := range c.BannedIPIDs {
-		if banned != ipid {
-			newBanned = append(newBanned, banned)
-		}
-	}
-	c.BannedIPIDs = newBanned
+	c.AdminPasswordHash = string(hash)
 	return c.saveInternal()
 }
 
@@ -133,41 +155,3 @@ func (c *Config) GetClanColor(tag string) string {
 	}
 	return "#FFFFFF" // Default white
 }
-
-func (c *Config) AddRoom(name string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	for _, r := range c.Rooms {
-		if r == name {
-			return nil // Already exists
-		}
-	}
-	c.Rooms = append(c.Rooms, name)
-	return c.saveInternal()
-}
-
-func (c *Config) RemoveRoom(name string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	var newRooms []string
-	for _, r := range c.Rooms {
-		if r != name {
-			newRooms = append(newRooms, r)
-		}
-	}
-	c.Rooms = newRooms
-	return c.saveInternal()
-}
-
-func (c *Config) RoomExists(name string) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	for _, r := range c.Rooms {
-		if r == name {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+// Where a ban was checked, as recorded in Evasion.
+const (
+	stageConnect  = "connect"  // Opening the websocket
+	stageSession  = "session"  // Resuming a saved login
+	stageLogin    = "login"    // /login
+	stageRegister = "register" // /register
+)
+
+const (
+	// maxEvasions is how many evasion attempts are kept; older ones are
+	// dropped first.
+	maxEvasions = 500
+
+	// banReportLimit is how many attempts /banreport shows.
+	banReportLimit = 20
+)
+
+// Evasion is an attempt to get around a ban: a banned account or address
+// turned away, or an account let in from where a banned user was seen.
+type Evasion struct {
+	Time     time.Time `json:"time"`
+	Stage    string    `json:"stage"`
+	Blocked  bool      `json:"blocked"`            // False if only suspected and let in
+	Username string    `json:"username,omitempty"` // Account used, if any
+	Addr     string    `json:"addr"`
+	BanID    string    `json:"ban_id"`
+	Banned   string    `json:"banned"` // Who or what the ban is of
+}
+
+// Evasions is the record behind the ban evasion report.
+type Evasions struct {
+	list []Evasion
+	mu   sync.RWMutex
+	file string
+}
+
+func NewEvasions(file string) *Evasions {
+	return &Evasions{file: file}
+}
+
+func (e *Evasions) Load() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	data, err := os.ReadFile(e.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &e.list)
+}
+
+// Helper to save the attempts without locking (must be called with lock held)
+func (e *Evasions) saveInternal() error {
+	data, err := json.MarshalIndent(e.list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(e.file, data, 0644)
+}
+
+// Add records an attempt.
+func (e *Evasions) Add(evasion Evasion) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.list = append(e.list, evasion)
+	if len(e.list) > maxEvasions {
+		e.list = e.list[len(e.list)-maxEvasions:]
+	}
+	return e.saveInternal()
+}
+
+// Recent returns up to limit of the latest attempts, oldest first, and
+// how many are recorded in all.
+func (e *Evasions) Recent(limit int) ([]Evasion, int) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	start := len(e.list) - limit
+	if start < 0 {
+		start = 0
+	}
+	return append([]Evasion(nil), e.list[start:]...), len(e.list)
+}
+
+// banNotice is what a banned user is told.
+func banNotice(ban Sanction) string {
+	if ban.Reason != "" {
+		return fmt.Sprintf("You are banned from this server %s: %s", ban.until(), ban.Reason)
+	}
+	return fmt.Sprintf("You are banned from this server %s.", ban.until())
+}
+
+// refuseBanned turns the connection away if user, or the address it comes
+// from, is banned: the client gets an error event and the server hangs up.
+// user is nil before the client has said who it is. A user let in from an
+// address a banned user was seen at is noted as a suspected evasion.
+func (c *Client) refuseBanned(user *model.User, stage string) bool {
+	ban, ok := c.hub.bans.Active(SanctionBan, user)
+	if !ok {
+		ban, ok = c.hub.bans.BannedAddr(c.addr)
+	}
+	if !ok {
+		if user != nil {
+			if seen, ok := c.hub.bans.SeenAt(c.addr); ok && seen.Username != user.Username {
+				c.hub.recordEvasion(seen, user, c.addr, stage, false)
+			}
+		}
+		return false
+	}
+
+	c.hub.recordEvasion(ban, user, c.addr, stage, true)
+	c.sendError(model.ErrBanned, banNotice(ban))
+	c.hangUp()
+	return true
+}
+
+// recordEvasion adds an attempt to the report.
+func (h *Hub) recordEvasion(ban Sanction, user *model.User, addr, stage string, blocked bool) {
+	evasion := Evasion{
+		Time:    time.Now(),
+		Stage:   stage,
+		Blocked: blocked,
+		Addr:    addr,
+		BanID:   ban.ID,
+		Banned:  ban.target(),
+	}
+	if user != nil {
+		evasion.Username = user.Username
+	}
+	if err := h.evasions.Add(evasion); err != nil {
+		log.Printf("Failed to record ban evasion: %v", err)
+	}
+	if blocked {
+		log.Printf("Refused banned %s at %s from %s (ban of %s)", evasion.Username, stage, addr, evasion.Banned)
+	} else {
+		log.Printf("Suspected ban evasion: %s at %s from %s, where banned %s was seen", evasion.Username, stage, addr, evasion.Banned)
+	}
+}
+
+// handleBanReport shows recent attempts to get around bans:
+// /banreport [count]
+func (c *Client) handleBanReport(args []string) {
+	if !c.require(PermBan, "") {
+		return
+	}
+	limit := banReportLimit
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			c.sendSystemMessage("Usage: /banreport [count]")
+			return
+		}
+		limit = n
+	} else if len(args) > 1 {
+		c.sendSystemMessage("Usage: /banreport [count]")
+		return
+	}
+
+	list, total := c.hub.evasions.Recent(limit)
+	if total == 0 {
+		c.sendSystemMessage("No ban evasion attempts recorded.")
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Ban evasion attempts (%d of %d):\n", len(list), total))
+	for _, e := range list {
+		sb.WriteString("• " + e.line() + "\n")
+	}
+	c.sendSystemMessage(sb.String())
+}
+
+// line describes the attempt on one line.
+func (e Evasion) line() string {
+	who := e.Username
+	if who == "" {
+		who = "(not logged in)"
+	}
+	what := "blocked"
+	if !e.Blocked {
+		what = "suspected"
+	}
+	return fmt.Sprintf("%s %s %s from %s at %s (ban of %s)", e.Time.Format("2006-01-02 15:04"), what, who, e.Addr, e.Stage, e.Banned)
+}
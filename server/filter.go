@@ -0,0 +1,606 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+// Kinds of filter rule.
+const (
+	FilterBlock  = "block"  // Pattern is a regular expression
+	FilterLink   = "link"   // No pattern
+	FilterCaps   = "caps"   // Pattern is the share of capitals, in percent
+	FilterRepeat = "repeat" // Pattern is how many times in a row
+)
+
+// What a filter rule does to a message that breaks it.
+const (
+	FilterReject = "reject" // Not posted; the sender is told
+	FilterMask   = "mask"   // Posted with the offending part hidden
+	FilterFlag   = "flag"   // Posted, and moderators are told
+)
+
+// filterActor is who flags are by in the moderation log.
+const filterActor = "(filter)"
+
+const (
+	// minCapsLetters is how many letters a message needs before caps
+	// rules look at it.
+	minCapsLetters = 10
+
+	// maxRepeatCount is the most repeats a repeat rule can wait for, and
+	// so how many of each user's messages in a room are remembered.
+	maxRepeatCount = 10
+
+	// repeatWindow is how long after their last message in a room a user's
+	// messages there are forgotten.
+	repeatWindow = 10 * time.Minute
+)
+
+// contentFilter finds messages that break a filter rule.
+type contentFilter interface {
+	// match reports whether content breaks the rule. recent holds what
+	// the sender last posted in the room, or in direct messages, oldest
+	// first.
+	match(content string, recent []string) bool
+}
+
+// contentMasker is a contentFilter that can hide the part of a message
+// that breaks its rule, for rules whose action is FilterMask.
+type contentMasker interface {
+	mask(content string) string
+}
+
+// filterKind is one kind of filter rule.
+type filterKind struct {
+	build  func(pattern string) (contentFilter, error)
+	reason string // What the sender of a rejected message is told, with the room
+}
+
+// filterKinds are the kinds of rule /filter add knows. New kinds plug in
+// here.
+var filterKinds = map[string]filterKind{
+	FilterBlock:  {newBlockFilter, "it contains words that aren't allowed in %s"},
+	FilterLink:   {newLinkFilter, "links aren't allowed in %s"},
+	FilterCaps:   {newCapsFilter, "it has too many capital letters for %s"},
+	FilterRepeat: {newRepeatFilter, "you sent the same message too many times in %s"},
+}
+
+// blockFilter matches a regular expression, ignoring case.
+type blockFilter struct {
+	re *regexp.Regexp
+}
+
+func newBlockFilter(pattern string) (contentFilter, error) {
+	if pattern == "" {
+		return nil, errors.New("block rules need a pattern")
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, err
+	}
+	return blockFilter{re}, nil
+}
+
+func (f blockFilter) match(content string, recent []string) bool {
+	return f.re.MatchString(content)
+}
+
+func (f blockFilter) mask(content string) string {
+	return f.re.ReplaceAllStringFunc(content, func(s string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(s))
+	})
+}
+
+// linkPattern matches URLs and bare www. addresses.
+var linkPattern = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+`)
+
+// linkFilter matches links.
+type linkFilter struct{}
+
+func newLinkFilter(pattern string) (contentFilter, error) {
+	if pattern != "" {
+		return nil, errors.New("link rules take no pattern")
+	}
+	return linkFilter{}, nil
+}
+
+func (linkFilter) match(content string, recent []string) bool {
+	return linkPattern.MatchString(content)
+}
+
+func (linkFilter) mask(content string) string {
+	return linkPattern.ReplaceAllString(content, "[link removed]")
+}
+
+// capsFilter matches messages written mostly in capitals.
+type capsFilter struct {
+	percent int
+}
+
+func newCapsFilter(pattern string) (contentFilter, error) {
+	percent, err := strconv.Atoi(pattern)
+	if err != nil || percent < 1 || percent > 100 {
+		return nil, errors.New("caps rules need a percentage from 1 to 100")
+	}
+	return capsFilter{percent}, nil
+}
+
+func (f capsFilter) match(content string, recent []string) bool {
+	letters, upper := 0, 0
+	for _, r := range content {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	return letters >= minCapsLetters && upper*100 >= letters*f.percent
+}
+
+func (f capsFilter) mask(content string) string {
+	return strings.ToLower(content)
+}
+
+// repeatFilter matches a message the sender already posted several times
+// in a row.
+type repeatFilter struct {
+	count int
+}
+
+func newRepeatFilter(pattern string) (contentFilter, error) {
+	count, err := strconv.Atoi(pattern)
+	if err != nil || count < 2 || count > maxRepeatCount {
+		return nil, fmt.Errorf("repeat rules need a count from 2 to %d", maxRepeatCount)
+	}
+	return repeatFilter{count}, nil
+}
+
+func (f repeatFilter) match(content string, recent []string) bool {
+	if len(recent) < f.count-1 {
+		return false
+	}
+	for _, prev := range recent[len(recent)-(f.count-1):] {
+		if !sameMessage(prev, content) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameMessage reports whether two messages say the same, give or take
+// case and surrounding space.
+func sameMessage(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// FilterRule is one rule of the message filter.
+type FilterRule struct {
+	ID      int       `json:"id"`
+	Kind    string    `json:"kind"`
+	Action  string    `json:"action"`
+	Room    string    `json:"room,omitempty"` // Empty for every room
+	Pattern string    `json:"pattern,omitempty"`
+	By      string    `json:"by"`
+	Created time.Time `json:"created"`
+
+	filter contentFilter // Nil if the pattern can't be used
+}
+
+// appliesTo reports whether the rule covers room.
+func (r *FilterRule) appliesTo(room string) bool {
+	return r.Room == "" || r.Room == room
+}
+
+// describe names the rule, for lists and the moderation log.
+func (r *FilterRule) describe() string {
+	where := "every room"
+	if r.Room != "" {
+		where = r.Room
+	}
+	text := fmt.Sprintf("#%d %s %s in %s", r.ID, r.Kind, r.Action, where)
+	if r.Pattern != "" {
+		text += fmt.Sprintf(": %s", r.Pattern)
+	}
+	return text
+}
+
+// compileFilterRule builds the filter of rule, and checks its action suits
+// its kind.
+func compileFilterRule(rule *FilterRule) error {
+	kind, ok := filterKinds[rule.Kind]
+	if !ok {
+		return fmt.Errorf("unknown kind %q", rule.Kind)
+	}
+	f, err := kind.build(rule.Pattern)
+	if err != nil {
+		return err
+	}
+	switch rule.Action {
+	case FilterReject, FilterFlag:
+	case FilterMask:
+		if _, ok := f.(contentMasker); !ok {
+			return fmt.Errorf("%s rules can't mask", rule.Kind)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+	rule.filter = f
+	return nil
+}
+
+// recentKey is a user posting in a room. The room is empty for direct
+// messages.
+type recentKey struct {
+	username string
+	room     string
+}
+
+// recentPosts are the latest messages of a user in a room.
+type recentPosts struct {
+	messages []string
+	last     time.Time
+}
+
+// filterResult is what the filter rules made of a message.
+type filterResult struct {
+	content  string       // The message, masked where rules asked for it
+	rejected *FilterRule  // The rule that stopped the message, if any
+	flagged  []FilterRule // The rules that flagged it for moderators
+}
+
+// Filters is the message filter: rules every room message passes through
+// before it is stored. Direct messages pass through the rules for every
+// room. Rules are kept in filters.json and can be changed while the server
+// runs.
+type Filters struct {
+	rules     []*FilterRule
+	recent    map[recentKey]*recentPosts // For repeat rules
+	lastSweep time.Time
+	mu        sync.RWMutex
+	file      string
+}
+
+func NewFilters(file string) *Filters {
+	return &Filters{file: file, recent: make(map[recentKey]*recentPosts)}
+}
+
+// Load reads the rules. A rule that can't be used is kept but skipped, and
+// logged.
+func (f *Filters) Load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := os.ReadFile(f.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &f.rules); err != nil {
+		return err
+	}
+	for _, rule := range f.rules {
+		if err := compileFilterRule(rule); err != nil {
+			log.Printf("Skipping filter rule #%d in %s: %v", rule.ID, f.file, err)
+		}
+	}
+	return nil
+}
+
+// Helper to save rules without locking (must be called with lock held)
+func (f *Filters) saveInternal() error {
+	data, err := json.MarshalIndent(f.rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.file, data, 0644)
+}
+
+// Add checks a rule and appends it to the chain, giving it the next ID.
+func (f *Filters) Add(rule FilterRule) (FilterRule, error) {
+	if err := compileFilterRule(&rule); err != nil {
+		return rule, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rule.ID = 1
+	for _, r := range f.rules {
+		if r.ID >= rule.ID {
+			rule.ID = r.ID + 1
+		}
+	}
+	rule.Created = time.Now()
+	f.rules = append(f.rules, &rule)
+	return rule, f.saveInternal()
+}
+
+// Remove drops the rule with id and returns it.
+func (f *Filters) Remove(id int) (FilterRule, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, r := range f.rules {
+		if r.ID == id {
+			f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			return *r, true, f.saveInternal()
+		}
+	}
+	return FilterRule{}, false, nil
+}
+
+// List returns the rules in the order they run.
+func (f *Filters) List() []FilterRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	list := make([]FilterRule, len(f.rules))
+	for i, r := range f.rules {
+		list[i] = *r
+	}
+	return list
+}
+
+// Apply runs content from username through the rules for room, in order.
+// An empty room stands for direct messages. Masks apply before later rules
+// look at the message; a rejection stops the chain.
+func (f *Filters) Apply(username, room, content string) filterResult {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	result := filterResult{content: content}
+	var recent []string
+	if p, ok := f.recent[recentKey{username, room}]; ok && time.Since(p.last) <= repeatWindow {
+		recent = p.messages
+	}
+	for _, rule := range f.rules {
+		if rule.filter == nil || !rule.appliesTo(room) || !rule.filter.match(result.content, recent) {
+			continue
+		}
+		switch rule.Action {
+		case FilterReject:
+			r := *rule
+			result.rejected = &r
+			return result
+		case FilterMask:
+			result.content = rule.filter.(contentMasker).mask(result.content)
+		case FilterFlag:
+			result.flagged = append(result.flagged, *rule)
+		}
+	}
+	return result
+}
+
+// Remember notes what username sent to room, for repeat rules.
+func (f *Filters) Remember(username, room, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.sweepInternal(now)
+	key := recentKey{username, room}
+	p, ok := f.recent[key]
+	if !ok || now.Sub(p.last) > repeatWindow {
+		p = &recentPosts{}
+		f.recent[key] = p
+	}
+	p.messages = append(p.messages, content)
+	if len(p.messages) > maxRepeatCount {
+		p.messages = p.messages[len(p.messages)-maxRepeatCount:]
+	}
+	p.last = now
+}
+
+// sweepInternal forgets the messages of users who went quiet, now and
+// then. Must be called with lock held.
+func (f *Filters) sweepInternal(now time.Time) {
+	if now.Sub(f.lastSweep) < repeatWindow {
+		return
+	}
+	f.lastSweep = now
+	for key, p := range f.recent {
+		if now.Sub(p.last) > repeatWindow {
+			delete(f.recent, key)
+		}
+	}
+}
+
+// DropRoom removes the rules for room and forgets what was sent there.
+func (f *Filters) DropRoom(room string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key := range f.recent {
+		if key.room == room {
+			delete(f.recent, key)
+		}
+	}
+	kept := f.rules[:0]
+	for _, r := range f.rules {
+		if r.Room != room {
+			kept = append(kept, r)
+		}
+	}
+	if len(kept) == len(f.rules) {
+		return nil
+	}
+	f.rules = kept
+	return f.saveInternal()
+}
+
+// RenameRoom moves the rules for a room, and what was sent there, to its
+// new name.
+func (f *Filters) RenameRoom(old, new string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, p := range f.recent {
+		if key.room == old {
+			delete(f.recent, key)
+			f.recent[recentKey{key.username, new}] = p
+		}
+	}
+	changed := false
+	for _, r := range f.rules {
+		if r.Room == old {
+			r.Room = new
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return f.saveInternal()
+}
+
+// filterMessage runs content about to be posted to room, or sent as a
+// direct message if room is empty, through the filter. It tells the client
+// and returns false if a rule rejects it.
+func (c *Client) filterMessage(room, content string) (filterResult, bool) {
+	result := c.hub.filters.Apply(c.user.Username, room, content)
+	if result.rejected == nil {
+		return result, true
+	}
+	where := room
+	if room == "" {
+		where = "direct messages"
+	}
+	reason := fmt.Sprintf(filterKinds[result.rejected.Kind].reason, where)
+	c.sendSystemMessage("Your message was not posted: " + reason + ".")
+	log.Printf("Filter rule #%d rejected a message from %s in %s", result.rejected.ID, c.user.Username, where)
+	return result, false
+}
+
+// flagMessage tells the moderators online that msg broke rules set to
+// flag, and records it in the moderation log.
+func (h *Hub) flagMessage(msg model.Message, rules []FilterRule) {
+	for _, rule := range rules {
+		h.recordAction(ModAction{
+			Actor:  filterActor,
+			Action: ModFlagMessage,
+			Target: msg.Sender,
+			Room:   msg.Room,
+			Reason: rule.describe(),
+			Detail: "message " + msg.ID,
+		})
+	}
+	where := msg.Room
+	if msg.Recipient != "" {
+		where = "a direct message to " + msg.Recipient
+	}
+	text := fmt.Sprintf("Filter flagged a message by %s in %s (rule #%d) [%s]: %s", msg.Sender, where, rules[0].ID, msg.ID, msg.Content)
+	bytes, err := model.EncodeEvent(model.EventMessage, systemMessage(text))
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if h.can(client.user, PermModLog, msg.Room) {
+			select {
+			case client.send <- bytes:
+			default:
+			}
+		}
+	}
+}
+
+// handleFilter shows and changes the filter rules:
+// /filter list, /filter add <kind> <action> <room|*> [pattern] and
+// /filter remove <id>
+func (c *Client) handleFilter(args []string) {
+	if !c.require(PermFilterManage, "") {
+		return
+	}
+	if len(args) < 1 {
+		c.sendSystemMessage("Usage: /filter <list|add|remove> ...")
+		return
+	}
+
+	switch args[0] {
+	case "list":
+		rules := c.hub.filters.List()
+		if len(rules) == 0 {
+			c.sendSystemMessage("No filter rules.")
+			return
+		}
+		var sb strings.Builder
+		sb.WriteString("Filter rules, in the order they run:\n")
+		for _, r := range rules {
+			sb.WriteString(fmt.Sprintf("• %s (by %s)", r.describe(), r.By))
+			if r.filter == nil {
+				sb.WriteString(" [invalid, skipped]")
+			}
+			sb.WriteString("\n")
+		}
+		c.sendSystemMessage(sb.String())
+
+	case "add":
+		if len(args) < 4 {
+			c.sendSystemMessage("Usage: /filter add <block|link|caps|repeat> <reject|mask|flag> <room|*> [pattern]")
+			return
+		}
+		rule := FilterRule{
+			Kind:    args[1],
+			Action:  args[2],
+			Room:    args[3],
+			Pattern: strings.Join(args[4:], " "),
+			By:      c.user.Username,
+		}
+		if rule.Room == "*" {
+			rule.Room = ""
+		} else if !c.hub.rooms.Exists(rule.Room) {
+			c.sendSystemMessage("Room does not exist.")
+			return
+		}
+		rule, err := c.hub.filters.Add(rule)
+		if err != nil {
+			c.sendSystemMessage("Failed to add filter rule: " + err.Error())
+			return
+		}
+		c.recordAction(ModFilterAdd, fmt.Sprintf("#%d", rule.ID), rule.Room, "", strings.TrimSpace(rule.Kind+" "+rule.Action+" "+rule.Pattern))
+		c.sendSystemMessage("Added filter rule " + rule.describe())
+		log.Printf("User %s added filter rule %s", c.user.Username, rule.describe())
+
+	case "remove":
+		if len(args) != 2 {
+			c.sendSystemMessage("Usage: /filter remove <id>")
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+		if err != nil {
+			c.sendSystemMessage("Usage: /filter remove <id>")
+			return
+		}
+		rule, ok, err := c.hub.filters.Remove(id)
+		if err != nil {
+			c.sendSystemMessage("Failed to remove filter rule: " + err.Error())
+			return
+		}
+		if !ok {
+			c.sendSystemMessage("No such filter rule.")
+			return
+		}
+		c.recordAction(ModFilterRemove, fmt.Sprintf("#%d", rule.ID), rule.Room, "", strings.TrimSpace(rule.Kind+" "+rule.Action+" "+rule.Pattern))
+		c.sendSystemMessage("Removed filter rule " + rule.describe())
+		log.Printf("User %s removed filter rule %s", c.user.Username, rule.describe())
+
+	default:
+		c.sendSystemMessage("Unknown subcommand.")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFiltersApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []FilterRule
+		recent   []string // What alice already sent to the room
+		room     string
+		content  string
+		want     string
+		rejected int   // ID of the rule that rejects, or 0
+		flagged  []int // IDs of the rules that flag
+	}{
+		{
+			name:    "no rules",
+			room:    "general",
+			content: "hello",
+			want:    "hello",
+		},
+		{
+			name:     "block rejects ignoring case",
+			rules:    []FilterRule{{Kind: FilterBlock, Action: FilterReject, Pattern: "spam"}},
+			room:     "general",
+			content:  "buy SPAM now",
+			want:     "buy SPAM now",
+			rejected: 1,
+		},
+		{
+			name:    "block masks",
+			rules:   []FilterRule{{Kind: FilterBlock, Action: FilterMask, Pattern: "darn"}},
+			room:    "general",
+			content: "darn it, Darn",
+			want:    "**** it, ****",
+		},
+		{
+			name:    "link masks",
+			rules:   []FilterRule{{Kind: FilterLink, Action: FilterMask}},
+			room:    "general",
+			content: "see https://example.com and www.example.org",
+			want:    "see [link removed] and [link removed]",
+		},
+		{
+			name:    "link flags",
+			rules:   []FilterRule{{Kind: FilterLink, Action: FilterFlag}},
+			room:    "general",
+			content: "http://example.com",
+			want:    "http://example.com",
+			flagged: []int{1},
+		},
+		{
+			name:    "caps masks",
+			rules:   []FilterRule{{Kind: FilterCaps, Action: FilterMask, Pattern: "70"}},
+			room:    "general",
+			content: "WHY IS NOBODY HERE",
+			want:    "why is nobody here",
+		},
+		{
+			name:    "caps ignores short messages",
+			rules:   []FilterRule{{Kind: FilterCaps, Action: FilterReject, Pattern: "70"}},
+			room:    "general",
+			content: "OK THEN",
+			want:    "OK THEN",
+		},
+		{
+			name:     "repeat rejects",
+			rules:    []FilterRule{{Kind: FilterRepeat, Action: FilterReject, Pattern: "3"}},
+			recent:   []string{"hi", "Hi ", "hi"},
+			room:     "general",
+			content:  "HI",
+			want:     "HI",
+			rejected: 1,
+		},
+		{
+			name:    "repeat waits for the count",
+			rules:   []FilterRule{{Kind: FilterRepeat, Action: FilterReject, Pattern: "3"}},
+			recent:  []string{"hi", "other", "hi"},
+			room:    "general",
+			content: "hi",
+			want:    "hi",
+		},
+		{
+			name:    "rule for another room",
+			rules:   []FilterRule{{Kind: FilterBlock, Action: FilterReject, Room: "lobby", Pattern: "spam"}},
+			room:    "general",
+			content: "spam",
+			want:    "spam",
+		},
+		{
+			name:     "direct messages pass every room rule",
+			rules:    []FilterRule{{Kind: FilterBlock, Action: FilterReject, Pattern: "spam"}},
+			content:  "spam",
+			want:     "spam",
+			rejected: 1,
+		},
+		{
+			name: "mask runs before later rules",
+			rules: []FilterRule{
+				{Kind: FilterLink, Action: FilterMask},
+				{Kind: FilterBlock, Action: FilterReject, Pattern: "example"},
+			},
+			room:    "general",
+			content: "go to http://example.com",
+			want:    "go to [link removed]",
+		},
+		{
+			name: "reject stops the chain",
+			rules: []FilterRule{
+				{Kind: FilterBlock, Action: FilterFlag, Pattern: "spam"},
+				{Kind: FilterBlock, Action: FilterReject, Pattern: "spam"},
+				{Kind: FilterBlock, Action: FilterFlag, Pattern: "spam"},
+			},
+			room:     "general",
+			content:  "spam",
+			want:     "spam",
+			rejected: 2,
+			flagged:  []int{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFilters(filepath.Join(t.TempDir(), "filters.json"))
+			for _, rule := range tt.rules {
+				if _, err := f.Add(rule); err != nil {
+					t.Fatalf("Add(%+v): %v", rule, err)
+				}
+			}
+			for _, content := range tt.recent {
+				f.Remember("alice", tt.room, content)
+			}
+
+			result := f.Apply("alice", tt.room, tt.content)
+			if result.content != tt.want {
+				t.Errorf("content = %q, want %q", result.content, tt.want)
+			}
+			rejected := 0
+			if result.rejected != nil {
+				rejected = result.rejected.ID
+			}
+			if rejected != tt.rejected {
+				t.Errorf("rejected by #%d, want #%d", rejected, tt.rejected)
+			}
+			var flagged []int
+			for _, rule := range result.flagged {
+				flagged = append(flagged, rule.ID)
+			}
+			if !slices.Equal(flagged, tt.flagged) {
+				t.Errorf("flagged by %v, want %v", flagged, tt.flagged)
+			}
+		})
+	}
+}
+
+func TestCompileFilterRule(t *testing.T) {
+	tests := []struct {
+		rule FilterRule
+		ok   bool
+	}{
+		{FilterRule{Kind: FilterBlock, Action: FilterReject, Pattern: "a+"}, true},
+		{FilterRule{Kind: FilterBlock, Action: FilterReject}, false},
+		{FilterRule{Kind: FilterBlock, Action: FilterReject, Pattern: "("}, false},
+		{FilterRule{Kind: FilterLink, Action: FilterMask, Pattern: "x"}, false},
+		{FilterRule{Kind: FilterCaps, Action: FilterFlag, Pattern: "0"}, false},
+		{FilterRule{Kind: FilterCaps, Action: FilterFlag, Pattern: "100"}, true},
+		{FilterRule{Kind: FilterRepeat, Action: FilterMask, Pattern: "3"}, false},
+		{FilterRule{Kind: FilterRepeat, Action: FilterReject, Pattern: "1"}, false},
+		{FilterRule{Kind: FilterRepeat, Action: FilterReject, Pattern: "10"}, true},
+		{FilterRule{Kind: "emoji", Action: FilterReject}, false},
+		{FilterRule{Kind: FilterLink, Action: "delete"}, false},
+	}
+
+	for _, tt := range tests {
+		err := compileFilterRule(&tt.rule)
+		if (err == nil) != tt.ok {
+			t.Errorf("compileFilterRule(%s %s %q) = %v, want ok %v", tt.rule.Kind, tt.rule.Action, tt.rule.Pattern, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Who gave a role, when it wasn't a logged-in user.
+const (
+	grantByConsole  = "(console)"
+	grantByPassword = "(admin password)"
+)
+
+// Grant is one change to someone's role: who got it, from whom and from
+// where. Every role change is recorded, so it can be traced who made
+// someone an admin.
+type Grant struct {
+	Username string    `json:"username"`
+	Role     string    `json:"role"`           // Empty if the role was taken away
+	Room     string    `json:"room,omitempty"` // Empty for server-wide roles
+	By       string    `json:"by"`             // Username, or grantByConsole / grantByPassword
+	Addr     string    `json:"addr,omitempty"` // Remote address the change came from
+	Time     time.Time `json:"time"`
+}
+
+// Grants is the record of role changes. Entries are only ever added.
+type Grants struct {
+	list []Grant
+	mu   sync.RWMutex
+	file string
+}
+
+func NewGrants(file string) *Grants {
+	return &Grants{file: file}
+}
+
+func (g *Grants) Load() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	data, err := os.ReadFile(g.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &g.list)
+}
+
+// Helper to save the grants without locking (must be called with lock held)
+func (g *Grants) saveInternal() error {
+	data, err := json.MarshalIndent(g.list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(g.file, data, 0600)
+}
+
+// Add records a role change.
+func (g *Grants) Add(grant Grant) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if grant.Time.IsZero() {
+		grant.Time = time.Now()
+	}
+	g.list = append(g.list, grant)
+	return g.saveInternal()
+}
+
+// Recent returns up to limit of the latest role changes, oldest first,
+// only those of username unless it is empty.
+func (g *Grants) Recent(username string, limit int) []Grant {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var list []Grant
+	for i := len(g.list) - 1; i >= 0 && len(list) < limit; i-- {
+		if username == "" || g.list[i].Username == username {
+			list = append(list, g.list[i])
+		}
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list
+}
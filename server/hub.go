@@ -41,100 +41,106 @@ type Client struct {
 	// Current user info (if logged in)
 	user *model.User
 
-	// Admin status
-	isAdmin bool
-
-	// Current room
+	// Active room, where chat text is posted
 	Room string
+
+	// Every room the connection is in, including the active one. Guarded
+	// by the hub's mu
+	subs map[string]bool
+
+	// Login session, issued at login or resumed from a saved token
+	session *Session
+
+	// Remote address the connection came from, without the port
+	addr string
+
+	// Set once the client's hello with a matching protocol version arrived
+	helloDone bool
+
+	// Set once the server has turned the client away. Only used by the
+	// goroutine reading from the client
+	hungUp bool
+
+	// Presence, guarded by the hub's mu
+	lastActive  time.Time
+	idle        bool
+	away        bool
+	awayMessage string
+}
+
+// roomEvent is an encoded event for every connection in a room.
+type roomEvent struct {
+	room string
+	data []byte
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the clients.
 type Hub struct {
 	clients    map[*Client]bool
-	broadcast  chan []byte
-	register   chan *Client
+	broadcast  chan roomEvent
 	unregister chan *Client
 	store      *Store
 	config     *Config
+	sessions   *Sessions
+	markers    *ReadMarkers
+	mentions   *Mentions
+	rooms      *Rooms
+	grants     *Grants
+	bans       *Sanctions
+	evasions   *Evasions
+	modlog     *ModLog
+	filters    *Filters
+	attempts   *AdminAttempts            // Wrong admin passwords
+	limiter    *RateLimiter              // Flood limits
+	lastPost   map[slowModeKey]time.Time // For slow mode, guarded by lastPostMu
 	mu         sync.Mutex
+
+	lastPostMu sync.Mutex
 }
 
-func NewHub(store *Store, config *Config) *Hub {
+func NewHub(store *Store, config *Config, sessions *Sessions, markers *ReadMarkers, mentions *Mentions, rooms *Rooms, grants *Grants, bans *Sanctions, evasions *Evasions, modlog *ModLog, filters *Filters) *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
+		broadcast:  make(chan roomEvent),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
 		store:      store,
 		config:     config,
+		sessions:   sessions,
+		markers:    markers,
+		mentions:   mentions,
+		rooms:      rooms,
+		grants:     grants,
+		bans:       bans,
+		evasions:   evasions,
+		modlog:     modlog,
+		filters:    filters,
+		attempts:   NewAdminAttempts(),
+		limiter:    NewRateLimiter(),
+		lastPost:   make(map[slowModeKey]time.Time),
 	}
 }
 
 func (h *Hub) Run() {
+	ticker := time.NewTicker(presenceCheckInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			h.clients[client] = true
-			h.mu.Unlock()
 		case client := <-h.unregister:
 			h.mu.Lock()
 			if _, ok := h.clients[client]; ok {
+				h.leaveRoomInternal(client)
 				delete(h.clients, client)
 				close(client.send)
 			}
 			h.mu.Unlock()
 		case message := <-h.broadcast:
-			// We need to decode the message to check the room?
-			// Or we can change broadcast channel to accept a struct with Room info?
-			// But broadcast is []byte.
-			// Let's decode it partially or assume we can peek?
-			// Actually, it's better to change broadcast to a struct or decode here.
-			// Decoding every time is expensive?
-			// Let's just decode it.
-
-			var event model.Event
-			if err := json.Unmarshal(message, &event); err != nil {
-				log.Printf("Error unmarshalling broadcast message: %v", err)
-				continue
-			}
-
-			// Check if it's a message event and has a room
-			var targetRoom string
-			if event.Type == model.EventMessage {
-				// Payload is map[string]interface{} after unmarshal if we don't know type?
-				// Wait, we just marshalled it from Message struct.
-				// But here we unmarshal into interface{}.
-				// Let's try to unmarshal payload to Message.
-
-				payloadBytes, _ := json.Marshal(event.Payload)
-				var msg model.Message
-				if err := json.Unmarshal(payloadBytes, &msg); err == nil {
-					targetRoom = msg.Room
-				}
-			}
-
-			if targetRoom == "" {
-				targetRoom = "general"
-			}
-
 			h.mu.Lock()
-			for client := range h.clients {
-				// Check client room
-				clientRoom := client.Room
-				if clientRoom == "" {
-					clientRoom = "general"
-				}
-
-				if clientRoom == targetRoom {
-					select {
-					case client.send <- message:
-					default:
-						close(client.send)
-						delete(h.clients, client)
-					}
-				}
-			}
+			h.deliverInternal(message.room, message.data)
+			h.mu.Unlock()
+		case now := <-ticker.C:
+			h.mu.Lock()
+			h.checkIdleInternal(now)
 			h.mu.Unlock()
 		}
 	}
@@ -156,11 +162,16 @@ func (c *Client) readPump() {
 			}
 			break
 		}
+		if c.hungUp {
+			// Drop what the client sent before it saw the server hang up
+			continue
+		}
 
 		// Handle incoming JSON messages
 		var event model.Event
 		if err := json.Unmarshal(message, &event); err != nil {
 			log.Printf("Invalid JSON: %v", err)
+			c.sendError(model.ErrInvalidPayload, "Malformed event: "+err.Error())
 			continue
 		}
 
@@ -178,8 +189,8 @@ func (c *Client) writePump() {
 		select {
 		case message, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
+			if !ok || message == nil {
+				// The hub closed the channel, or hung up on the client
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
@@ -209,48 +220,87 @@ func (c *Client) writePump() {
 }
 
 func (c *Client) handleEvent(event model.Event) {
+	if event.Type != model.EventHello && !c.helloDone {
+		// Clients from before the typed protocol never send a hello
+		c.rejectProtocol(fmt.Sprintf("No hello received. This server speaks protocol v%d; please update your client.", model.ProtocolVersion))
+		return
+	}
+
 	switch event.Type {
-	case model.EventLogin:
-		// Handle login/register
-		// Payload should be LoginPayload
-		payloadBytes, _ := json.Marshal(event.Payload)
-		var payload model.LoginPayload
-		json.Unmarshal(payloadBytes, &payload)
-
-		// For simplicity, auto-register if not exists, else login
-		// Wait, the requirements say /register and /login commands.
-		// But here we are at the websocket layer.
-		// The client TUI will send commands as messages or specific events?
-		// The README says "User commands: /register ... /login ..."
-		// So the client sends a message starting with /.
-		// But we need to be authenticated to send messages?
-		// Or maybe we allow anonymous connection and then login?
-		// Let's assume the client sends a "login" event for explicit login.
-		// But if we follow the README strictly, the user types /login in the input area.
-		// So the client sends a "message" event with content "/login ...".
-		// The server parses it.
-
-		// However, for TUI, it might be easier to handle auth before joining chat?
-		// The README says: "User commands... /register... /login...".
-		// This implies you are already connected to the server (websocket established) and typing commands.
-		// So we should handle everything as "message" event, and check if it's a command.
+	case model.EventHello:
+		var hello model.HelloPayload
+		if err := event.Decode(&hello); err != nil {
+			c.rejectProtocol(err.Error())
+			return
+		}
+		if err := hello.CheckVersion("client"); err != nil {
+			c.rejectProtocol(err.Error())
+			return
+		}
+		c.helloDone = true
 
 	case model.EventMessage:
-		// Payload is just string content or Message struct?
-		// Let's assume payload is map for now or we re-marshal.
-		// Actually, let's simplify. The client sends a Message struct?
-		// No, the client sends text. The server wraps it in Message struct.
-
-		content, ok := event.Payload.(string)
-		if !ok {
+		var payload model.SendPayload
+		if err := event.Decode(&payload); err != nil {
+			c.sendError(model.ErrInvalidPayload, err.Error())
+			return
+		}
+		if !c.checkRate(payload.Content) {
+			return
+		}
+		c.hub.markActive(c)
+		if payload.Room != "" && !c.setActiveRoom(payload.Room) && !strings.HasPrefix(payload.Content, "/") {
+			c.sendSystemMessage(fmt.Sprintf("You are not in %s. Join it with /room join %s", payload.Room, payload.Room))
 			return
 		}
 
 		// Process command or chat
-		c.processMessage(content)
+		c.processMessage(payload.Content)
+
+	case model.EventMarkRead:
+		var payload model.ReadPayload
+		if err := event.Decode(&payload); err != nil {
+			c.sendError(model.ErrInvalidPayload, err.Error())
+			return
+		}
+		if !c.checkEventRate() {
+			return
+		}
+		c.markRead(payload)
+
+	case model.EventTyping:
+		var payload model.TypingPayload
+		if err := event.Decode(&payload); err != nil {
+			c.sendError(model.ErrInvalidPayload, err.Error())
+			return
+		}
+		if !c.checkEventRate() {
+			return
+		}
+		c.hub.markActive(c)
+		c.handleTyping(payload)
+
+	default:
+		c.sendError(model.ErrInvalidPayload, fmt.Sprintf("Unknown event type %q.", event.Type))
 	}
 }
 
+// rejectProtocol tells the client why it can't be served and hangs up once
+// the error has been delivered.
+func (c *Client) rejectProtocol(reason string) {
+	log.Printf("Rejecting client: %s", reason)
+	c.sendError(model.ErrProtocolMismatch, reason)
+	c.hangUp()
+}
+
+// hangUp closes the connection once what is queued for it has been sent.
+// Events the client sends meanwhile are dropped. Must be called from
+// serveWs or the read pump.
+func (c *Client) hangUp() {
+	c.hungUp = true
+	c.send <- nil
+}
+
 func (c *Client) processMessage(content string) {
 	// Check for commands
 	if len(content) > 0 && content[0] == '/' {
@@ -263,9 +313,6 @@ func (c *Client) processMessage(content string) {
 		return
 	}
 
-	// Set admin status from user
-	c.isAdmin = c.user.IsAdmin
-
 	// Send history if this is the first message (login success)
 	// But processMessage is called for every message.
 	// We need to send history only once upon login.
@@ -276,6 +323,54 @@ func (c *Client) processMessage(content string) {
 	// We need to send history right after successful login/register in commands.go.
 	// So let's move history sending to commands.go or add a method here.
 
+	msg := c.newMessage(content)
+	msg.Room = c.roomName()
+	c.postMessage(msg)
+}
+
+// postMessage stores a chat message in its room and delivers it to the
+// room, the unread counts and anyone it mentions.
+func (c *Client) postMessage(msg model.Message) {
+	if !c.require(PermPost, msg.Room) || !c.checkMuted() || !c.checkWritable(msg.Room) || !c.checkMessageLength(msg.Room, msg.Content) || !c.checkSlowMode(msg.Room) {
+		return
+	}
+	filtered, ok := c.filterMessage(msg.Room, msg.Content)
+	c.hub.filters.Remember(c.user.Username, msg.Room, msg.Content)
+	if !ok {
+		return
+	}
+	msg.Content = filtered.content
+	msg.Mentions = c.hub.findMentions(msg.Content, msg.Room, c.user.Username)
+
+	msg, err := c.hub.store.AddMessage(msg)
+	if err != nil {
+		log.Printf("Failed to store message from %s: %v", c.user.Username, err)
+		c.sendSystemMessage("Failed to send message.")
+		return
+	}
+
+	// Log the message
+	if msg.ReplyTo != "" {
+		log.Printf("Reply from %s (%s) in %s to %s: %s", c.user.Username, c.user.IPID, msg.Room, msg.ReplyTo, msg.Content)
+	} else {
+		log.Printf("Message from %s (%s) in %s: %s", c.user.Username, c.user.IPID, msg.Room, msg.Content)
+	}
+
+	// Broadcast
+	c.hub.broadcastEvent(msg.Room, model.EventMessage, msg)
+
+	// Posting means the sender has caught up
+	c.hub.advanceMarker(c.user.Username, msg)
+	c.hub.notifyUnread(msg.Room, c.user.Username)
+	c.hub.notifyMentions(msg)
+	if len(filtered.flagged) > 0 {
+		c.hub.flagMessage(msg, filtered.flagged)
+	}
+}
+
+// newMessage builds a chat message from the logged-in user, with the
+// display name and IPID as others should see them.
+func (c *Client) newMessage(content string) model.Message {
 	// Format sender with clans
 	senderName := c.user.Username
 	if c.user.DisplayName != "" {
@@ -296,7 +391,7 @@ func (c *Client) processMessage(content string) {
 
 	// Mask IPID if admin
 	senderID := c.user.IPID
-	if c.isAdmin {
+	if atLeast(globalRole(c.user), RoleAdmin) {
 		parts := strings.Split(senderID, ".")
 		if len(parts) == 4 {
 			parts[3] = c.hub.config.AdminIPIDSuffix
@@ -304,49 +399,106 @@ func (c *Client) processMessage(content string) {
 		}
 	}
 
-	// Default room is "general" if not set
-	if c.Room == "" {
-		c.Room = "general"
-	}
-
-	msg := model.Message{
+	return model.Message{
 		Sender:        c.user.Username,
 		SenderDisplay: senderName, // senderName contains tags and display name
 		SenderID:      senderID,
 		Content:       content,
-		Room:          c.Room,
 		Timestamp:     time.Now(),
 		IsSystem:      false,
 	}
+}
 
-	c.hub.store.AddMessage(msg)
+// sendEvent queues an event for this connection only.
+func (c *Client) sendEvent(t model.EventType, payload interface{}) {
+	bytes, err := model.EncodeEvent(t, payload)
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	c.send <- bytes
+}
 
-	// Log the message
-	log.Printf("Message from %s (%s) in %s: %s", c.user.Username, c.user.IPID, c.Room, content)
+// broadcastEvent sends an event to every connection in room.
+func (h *Hub) broadcastEvent(room string, t model.EventType, payload interface{}) {
+	bytes, err := model.EncodeEvent(t, payload)
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	h.broadcast <- roomEvent{room: room, data: bytes}
+}
 
-	// Broadcast
-	broadcastEvent := model.Event{
-		Type:    model.EventMessage,
-		Payload: msg,
+// handleTyping passes the client's typing state on to the room it names
+// (or the active room), or to the recipient of the direct message being
+// typed.
+func (c *Client) handleTyping(payload model.TypingPayload) {
+	if c.user == nil {
+		return
+	}
+	out := model.TypingPayload{Typing: payload.Typing, User: c.user.Username}
+	if payload.Recipient == "" {
+		out.Room = c.roomName()
+		if payload.Room != "" && c.inRoom(payload.Room) {
+			out.Room = payload.Room
+		}
+		c.hub.broadcastEvent(out.Room, model.EventTyping, out)
+		return
+	}
+	target, ok := c.hub.store.GetUser(payload.Recipient)
+	if !ok || target.Username == c.user.Username {
+		return
 	}
-	bytes, _ := json.Marshal(broadcastEvent)
-	c.hub.broadcast <- bytes
+	out.Recipient = target.Username
+	bytes, err := model.EncodeEvent(model.EventTyping, out)
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	c.hub.sendToUser(target.Username, bytes)
 }
 
-func (c *Client) sendSystemMessage(text string) {
-	msg := model.Message{
+// publishMessageEvent sends an event about msg to everyone who can see it:
+// the room it was posted in, or both sides of a direct message. A nil
+// payload sends the message itself.
+func (h *Hub) publishMessageEvent(t model.EventType, msg model.Message, payload interface{}) {
+	if payload == nil {
+		payload = msg
+	}
+	if msg.Recipient == "" {
+		h.broadcastEvent(msg.Room, t, payload)
+		return
+	}
+	bytes, err := model.EncodeEvent(t, payload)
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	h.sendToUser(msg.Recipient, bytes)
+	h.sendToUser(msg.Sender, bytes)
+}
+
+// systemMessage builds a notice from the server. System messages are not
+// stored.
+func systemMessage(text string) model.Message {
+	return model.Message{
 		Sender:    "System",
 		SenderID:  "0.0.0.0",
 		Content:   text,
 		Timestamp: time.Now(),
 		IsSystem:  true,
 	}
-	event := model.Event{
-		Type:    model.EventMessage,
-		Payload: msg,
-	}
-	bytes, _ := json.Marshal(event)
-	c.send <- bytes
+}
+
+func (c *Client) sendSystemMessage(text string) {
+	c.sendEvent(model.EventMessage, systemMessage(text))
+}
+
+// roomNotice sends a system message to everyone in room.
+func (h *Hub) roomNotice(room, text string) {
+	msg := systemMessage(text)
+	msg.Room = room
+	h.broadcastEvent(room, model.EventMessage, msg)
 }
 
 // serveWs handles websocket requests from the peer.
@@ -356,43 +508,189 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
+	client := &Client{
+		hub:  hub,
+		conn: conn,
+		send: make(chan []byte, 256),
+		subs: map[string]bool{"general": true},
+		addr: remoteHost(r),
+	}
+	// Added right away rather than through Run, so presence and unread
+	// updates sent while logging in already count this connection
+	hub.mu.Lock()
+	hub.clients[client] = true
+	hub.mu.Unlock()
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writePump()
-	go client.readPump()
+
+	// Introduce ourselves; the client checks the protocol version
+	client.sendEvent(model.EventHello, model.HelloPayload{
+		ProtocolVersion: model.ProtocolVersion,
+		ServerName:      hub.config.ServerName,
+	})
 
 	// Send welcome message
 	client.sendSystemMessage(hub.config.WelcomeMessage)
 
-	// Send server info
-	serverInfo := map[string]string{
-		"server_name": hub.config.ServerName,
+	// Banned addresses are turned away before anything else. The read pump
+	// still runs, to notice the connection closing
+	if client.refuseBanned(nil, stageConnect) {
+		go client.readPump()
+		return
 	}
-	event := model.Event{
-		Type:    "server_info",
-		Payload: serverInfo,
+
+	// Resume a saved login before reading any commands
+	if token := bearerToken(r); token != "" && !client.resumeSession(token) {
+		go client.readPump()
+		return
+	}
+
+	// A reconnecting client asks to be put back in the rooms it was in
+	if client.user != nil {
+		query := r.URL.Query()
+		var rooms []string
+		if list := query.Get("rooms"); list != "" {
+			rooms = strings.Split(list, ",")
+		}
+		client.restoreRooms(rooms, query.Get("room"))
+		client.sendRoomUpdate()
+	}
+	hub.enterRoom(client)
+
+	go client.readPump()
+}
+
+// EndSessions logs out every connection using one of the revoked sessions.
+// The connection that asked for the revocation is told about it but keeps
+// its login for the rest of the connection. The others are told and hung
+// up, so their own read pumps unregister them; they reconnect logged out.
+func (h *Hub) EndSessions(revoked []*Session, requester *Client) {
+	ids := make(map[string]bool)
+	for _, sess := range revoked {
+		ids[sess.ID] = true
+	}
+
+	loggedOut, err := model.EncodeEvent(model.EventSession, model.SessionPayload{})
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	notice, err := model.EncodeEvent(model.EventMessage, systemMessage("Your session was revoked. Please /login again."))
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if client.session == nil || !ids[client.session.ID] {
+			continue
+		}
+		if client == requester {
+			client.session = nil
+			h.sendInternal(client, loggedOut)
+			continue
+		}
+		// Queued without waiting: a connection that can't take them is dropped
+		if h.sendInternal(client, loggedOut) && h.sendInternal(client, notice) {
+			h.sendInternal(client, nil)
+		}
 	}
-	bytes, _ := json.Marshal(event)
-	client.send <- bytes
 }
 
-func (h *Hub) KickUser(ipid string) bool {
+// sendToUser delivers an encoded event to every connection logged in as
+// username.
+func (h *Hub) sendToUser(username string, data []byte) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	for client := range h.clients {
+		if client.user != nil && client.user.Username == username {
+			select {
+			case client.send <- data:
+			default:
+			}
+		}
+	}
+}
 
+// notifyUser sends a system message to every connection of username.
+func (h *Hub) notifyUser(username, text string) {
+	if bytes, err := model.EncodeEvent(model.EventMessage, systemMessage(text)); err == nil {
+		h.sendToUser(username, bytes)
+	}
+}
+
+// KickUser disconnects every connection of the user with ipid, and
+// records it in the moderation log as done by by from addr. It reports
+// whether the user was connected.
+func (h *Hub) KickUser(ipid, by, addr string) bool {
+	notice, err := model.EncodeEvent(model.EventMessage, systemMessage("You have been kicked."))
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return false
+	}
+
+	h.mu.Lock()
+	username := ""
 	for client := range h.clients {
 		if client.user != nil && client.user.IPID == ipid {
-			client.sendSystemMessage("You have been kicked by admin.")
-			client.conn.Close()
-			delete(h.clients, client)
-			close(client.send)
-			return true
+			username = client.user.Username
+			// The write pump hangs up after the notice, and the read pump
+			// then unregisters the client as for any disconnect
+			if h.sendInternal(client, notice) {
+				h.sendInternal(client, nil)
+			}
 		}
 	}
-	return false
+	h.mu.Unlock()
+
+	if username == "" {
+		return false
+	}
+	h.recordAction(ModAction{Actor: by, Action: ModKick, Target: username, Addr: addr})
+	log.Printf("%s kicked %s", by, username)
+	return true
+}
+
+// disconnectBanned hangs up on every connection ban applies to, telling
+// it why.
+func (h *Hub) disconnectBanned(ban Sanction) {
+	notice, err := model.EncodeEvent(model.EventError, model.ErrorPayload{Code: model.ErrBanned, Message: banNotice(ban)})
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients {
+		if ban.matchesAddr(client.addr) || (client.user != nil && ban.matches(client.user.Username, client.user.IPID)) {
+			// The write pump hangs up after the notice; a connection too
+			// slow to take it is dropped straight away
+			if h.sendInternal(client, notice) {
+				h.sendInternal(client, nil)
+			}
+		}
+	}
+}
+
+// addrsOf lists the addresses username is connected from.
+func (h *Hub) addrsOf(username string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var addrs []string
+	for client := range h.clients {
+		if client.user != nil && client.user.Username == username && client.addr != "" && !seen[client.addr] {
+			seen[client.addr] = true
+			addrs = append(addrs, client.addr)
+		}
+	}
+	return addrs
 }
 
 func (h *Hub) BroadcastSystemMessage(msg string) {
@@ -403,12 +701,25 @@ func (h *Hub) BroadcastSystemMessage(msg string) {
 		Timestamp: time.Now(),
 		IsSystem:  true,
 	}
-	event := model.Event{
-		Type:    model.EventMessage,
-		Payload: message,
+	h.broadcastEvent(message.Room, model.EventMessage, message)
+}
+
+// CanReadRoom reports whether user may read the history of room: it is
+// open to everyone, or they are a member of it or an admin.
+func (h *Hub) CanReadRoom(user *model.User, room string) bool {
+	return user != nil && h.rooms.CanAccess(room, user.Username, h.can(user, PermRoomReadAll, ""))
+}
+
+// CanReadMessage reports whether user may see msg: it is in a room they
+// can read, or a direct message they sent or received.
+func (h *Hub) CanReadMessage(user *model.User, msg model.Message) bool {
+	if user == nil {
+		return false
+	}
+	if msg.Recipient != "" {
+		return msg.Sender == user.Username || msg.Recipient == user.Username
 	}
-	bytes, _ := json.Marshal(event)
-	h.broadcast <- bytes
+	return h.CanReadRoom(user, msg.Room)
 }
 
 func (c *Client) SendHistory() {
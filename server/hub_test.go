@@ -0,0 +1,96 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+// newTestHub returns a hub whose files all live in a temporary directory.
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	modlog, err := OpenModLog(path("modlog.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { modlog.Close() })
+	return NewHub(
+		NewStore(path("users.json"), path("messages")),
+		NewConfig(path("server_config.json")),
+		NewSessions(path("sessions.json"), time.Hour),
+		NewReadMarkers(path("read_markers.json")),
+		NewMentions(path("mentions.json")),
+		NewRooms(path("rooms.json")),
+		NewGrants(path("grants.json")),
+		NewSanctions(path("bans.json")),
+		NewEvasions(path("ban_evasion.json")),
+		modlog,
+		NewFilters(path("filters.json")),
+	)
+}
+
+// addTestUser puts a user straight into the store of h, skipping the
+// password hashing of RegisterUser.
+func addTestUser(h *Hub, username, role, ipid string) *model.User {
+	user := &model.User{Username: username, Role: role, IPID: ipid}
+	h.store.mu.Lock()
+	h.store.Users[username] = user
+	h.store.mu.Unlock()
+	return user
+}
+
+func TestCanRead(t *testing.T) {
+	h := newTestHub(t)
+	alice := addTestUser(h, "alice", "", "111.111.111.111")
+	bob := addTestUser(h, "bob", "", "222.222.222.222")
+	admin := addTestUser(h, "root", RoleAdmin, "333.333.333.331")
+
+	for _, room := range []struct{ name, visibility string }{
+		{"general", RoomPublic},
+		{"secret", RoomPrivate},
+		{"club", RoomInviteOnly},
+	} {
+		if err := h.rooms.Create(room.name, "", room.visibility, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.rooms.AddMember("club", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user *model.User
+		msg  model.Message
+		want bool
+	}{
+		{"nobody", nil, model.Message{Room: "general"}, false},
+		{"public room", bob, model.Message{Room: "general"}, true},
+		{"private room", bob, model.Message{Room: "secret"}, false},
+		{"private room as admin", admin, model.Message{Room: "secret"}, true},
+		{"invite-only as member", alice, model.Message{Room: "club"}, true},
+		{"invite-only as outsider", bob, model.Message{Room: "club"}, false},
+		{"missing room", admin, model.Message{Room: "gone"}, false},
+		{"direct message sent", alice, model.Message{Sender: "alice", Recipient: "bob"}, true},
+		{"direct message received", bob, model.Message{Sender: "alice", Recipient: "bob"}, true},
+		{"direct message of others", admin, model.Message{Sender: "alice", Recipient: "bob"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.CanReadMessage(tt.user, tt.msg); got != tt.want {
+				t.Errorf("CanReadMessage() = %v, want %v", got, tt.want)
+			}
+			if tt.msg.Recipient == "" {
+				if got := h.CanReadRoom(tt.user, tt.msg.Room); got != tt.want {
+					t.Errorf("CanReadRoom(%q) = %v, want %v", tt.msg.Room, got, tt.want)
+				}
+			}
+		})
+	}
+}
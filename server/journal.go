@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+const (
+	journalExt = ".jsonl"
+	legacyExt  = ".json"
+
+	// A journal is rewritten once enough of its lines are dead weight.
+	compactMinStale = 256
+	compactInterval = 5 * time.Minute
+)
+
+// journal is an append-only log of messages for one room, stored as one
+// JSON object per line in messages/<room>.jsonl.
+//
+// Appends are a single write of one line, so a crash can at worst leave a
+// torn last line. That line is cut off the next time the journal is opened.
+type journal struct {
+	path    string
+	file    *os.File
+	size    int64 // Bytes of complete lines in the file
+	records int   // Lines in the file
+	stale   int   // Lines that compaction would drop
+	lastSeq int64 // Highest Seq the room has handed out
+	mu      sync.Mutex
+}
+
+// journalHeader is the first line of a compacted journal. It keeps the
+// highest Seq of the room, which no message may hold any more once
+// retention has pruned them, so numbering never starts over.
+type journalHeader struct {
+	LastSeq int64 `json:"last_seq"`
+}
+
+// journalLine is a line of a journal: a message, or the header.
+type journalLine struct {
+	model.Message
+	journalHeader
+}
+
+// openJournal opens (or creates) the journal at path and returns the
+// messages it holds. A torn trailing line is truncated away.
+func openJournal(path string) (*journal, []model.Message, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contents, err := readJournal(f, -1)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	msgs := latestMessages(contents.msgs)
+	size := contents.size
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.Size() > size {
+		log.Printf("Journal %s: truncating torn tail (%d bytes)", path, info.Size()-size)
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+
+	j := &journal{
+		path:    path,
+		file:    f,
+		size:    size,
+		records: contents.lines,
+		stale:   len(contents.msgs) - len(msgs) + contents.bad,
+		lastSeq: contents.lastSeq,
+	}
+	return j, msgs, nil
+}
+
+// latestMessages collapses repeated lines for the same message ID down to
+// the last one written, keeping the position of the first.
+func latestMessages(msgs []model.Message) []model.Message {
+	out := make([]model.Message, 0, len(msgs))
+	pos := make(map[string]int, len(msgs))
+	for _, msg := range msgs {
+		if msg.ID != "" {
+			if i, ok := pos[msg.ID]; ok {
+				out[i] = msg
+				continue
+			}
+			pos[msg.ID] = len(out)
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// journalContents is what readJournal found in a journal.
+type journalContents struct {
+	msgs    []model.Message
+	lastSeq int64 // Highest Seq in the header or any message
+	size    int64 // Bytes of complete lines
+	lines   int   // Complete lines, the header included
+	bad     int   // Lines that could not be decoded
+}
+
+// readJournal decodes complete lines from r, stopping after limit bytes
+// (or at EOF if limit is negative).
+func readJournal(r io.ReaderAt, limit int64) (journalContents, error) {
+	var src io.Reader = io.NewSectionReader(r, 0, 1<<62)
+	if limit >= 0 {
+		src = io.NewSectionReader(r, 0, limit)
+	}
+	reader := bufio.NewReader(src)
+
+	var c journalContents
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything left without a newline is a torn write
+			break
+		}
+		if err != nil {
+			return journalContents{}, err
+		}
+		c.size += int64(len(line))
+		c.lines++
+
+		var l journalLine
+		if err := json.Unmarshal(bytes.TrimSpace(line), &l); err != nil {
+			c.bad++
+			continue
+		}
+		if l.ID == "" && l.LastSeq > 0 {
+			c.lastSeq = max(c.lastSeq, l.LastSeq)
+			continue
+		}
+		c.lastSeq = max(c.lastSeq, l.Seq)
+		c.msgs = append(c.msgs, l.Message)
+	}
+	return c, nil
+}
+
+// Append writes msg as a new line at the end of the journal.
+func (j *journal) Append(msg model.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(data); err != nil {
+		// Drop a partial line so later appends stay readable
+		j.file.Truncate(j.size)
+		return err
+	}
+	j.size += int64(len(data))
+	j.records++
+	j.lastSeq = max(j.lastSeq, msg.Seq)
+	return nil
+}
+
+// LastSeq returns the highest Seq the room has handed out, even if the
+// message that had it is gone.
+func (j *journal) LastSeq() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lastSeq
+}
+
+// keepSeq makes the journal remember seq as handed out, as when it takes
+// over the history of another.
+func (j *journal) keepSeq(seq int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.lastSeq = max(j.lastSeq, seq)
+}
+
+// Replace appends a new version of a message already in the journal. The
+// old line becomes stale and is dropped at the next compaction.
+func (j *journal) Replace(msg model.Message) error {
+	if err := j.Append(msg); err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.stale++
+	j.mu.Unlock()
+	return nil
+}
+
+// needsCompaction reports whether enough stale lines have built up.
+func (j *journal) needsCompaction() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stale >= compactMinStale || (j.stale > 0 && j.stale*2 >= j.records)
+}
+
+// compact rewrites the journal with the latest version of each message,
+// filtered through keep, after a header with the highest Seq.
+// Appends keep going while the bulk of the file is rewritten; they are only
+// blocked while the lines written in the meantime are copied over.
+func (j *journal) compact(keep func([]model.Message) []model.Message) error {
+	j.mu.Lock()
+	end := j.size
+	lastSeq := j.lastSeq
+	j.mu.Unlock()
+
+	contents, err := readJournal(j.file, end)
+	if err != nil {
+		return err
+	}
+	msgs := keep(latestMessages(contents.msgs))
+	for _, msg := range msgs {
+		lastSeq = max(lastSeq, msg.Seq)
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // No-op once renamed
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	headers := 0
+	if lastSeq > 0 {
+		if err := enc.Encode(journalHeader{LastSeq: lastSeq}); err != nil {
+			tmp.Close()
+			return err
+		}
+		headers++
+	}
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Carry over lines appended since we took the snapshot
+	tail := io.NewSectionReader(j.file, end, j.size-end)
+	tailRecords := 0
+	tailReader := bufio.NewReader(tail)
+	for {
+		line, err := tailReader.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, err := w.Write(line); err != nil {
+				tmp.Close()
+				return err
+			}
+			tailRecords++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Renaming now would lose the lines we couldn't copy
+			tmp.Close()
+			return fmt.Errorf("copy lines appended during compaction: %w", err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("reopen after compaction: %w", err)
+	}
+	j.file.Close()
+	j.file = f
+	j.size = info.Size()
+	j.records = headers + len(msgs) + tailRecords
+	j.lastSeq = max(j.lastSeq, lastSeq)
+	// The copied lines may still replace messages written before them
+	j.stale = tailRecords
+
+	// Make the rename itself survive a crash
+	if err := syncDir(filepath.Dir(j.path)); err != nil {
+		log.Printf("Failed to sync directory of %s after compaction: %v", j.path, err)
+	}
+	return nil
+}
+
+// syncDir flushes changes to the entries of dir, such as a rename, to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// rewrite replaces the journal contents with msgs. It is only safe while
+// nothing else is appending, e.g. during Store.Load.
+func (j *journal) rewrite(msgs []model.Message) error {
+	return j.compact(func([]model.Message) []model.Message { return msgs })
+}
+
+func (j *journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// migrateLegacyRoom converts a messages/<room>.json array written by older
+// versions into a journal. The original file is kept as <room>.json.bak.
+func migrateLegacyRoom(legacyPath, journalPath string) error {
+	data, err := os.ReadFile(legacyPath)
+	if err != nil {
+		return err
+	}
+	var msgs []model.Message
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := journalPath + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, journalPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	log.Printf("Migrated %s to %s (%d messages)", legacyPath, journalPath, len(msgs))
+	return os.Rename(legacyPath, legacyPath+".bak")
+}
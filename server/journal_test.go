@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+func TestOpenJournalReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     []string // Content of each message, in order
+		lastSeq  int64
+		size     int64 // Bytes left after a torn tail is cut
+		stale    int
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "appends",
+			contents: `{"id":"a","seq":1,"content":"one"}
+{"id":"b","seq":2,"content":"two"}
+`,
+			want:    []string{"one", "two"},
+			lastSeq: 2,
+			size:    70,
+		},
+		{
+			name: "edit keeps position",
+			contents: `{"id":"a","seq":1,"content":"one"}
+{"id":"b","seq":2,"content":"two"}
+{"id":"a","seq":1,"content":"edited"}
+`,
+			want:    []string{"edited", "two"},
+			lastSeq: 2,
+			size:    108,
+			stale:   1,
+		},
+		{
+			name: "torn tail",
+			contents: `{"id":"a","seq":1,"content":"one"}
+{"id":"b","seq":2,"cont`,
+			want:    []string{"one"},
+			lastSeq: 1,
+			size:    35,
+		},
+		{
+			name: "bad line",
+			contents: `{"id":"a","seq":1,"content":"one"}
+not json
+{"id":"b","seq":2,"content":"two"}
+`,
+			want:    []string{"one", "two"},
+			lastSeq: 2,
+			size:    79,
+			stale:   1,
+		},
+		{
+			name: "header after pruning",
+			contents: `{"last_seq":9}
+{"id":"a","seq":7,"content":"seven"}
+`,
+			want:    []string{"seven"},
+			lastSeq: 9,
+			size:    52,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "room"+journalExt)
+			if err := os.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			j, msgs, err := openJournal(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer j.Close()
+
+			if got := contents(msgs); !slices.Equal(got, tt.want) {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+			if j.LastSeq() != tt.lastSeq {
+				t.Errorf("LastSeq() = %d, want %d", j.LastSeq(), tt.lastSeq)
+			}
+			if j.stale != tt.stale {
+				t.Errorf("stale = %d, want %d", j.stale, tt.stale)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != tt.size || j.size != tt.size {
+				t.Errorf("file size = %d, journal size = %d, want %d", info.Size(), j.size, tt.size)
+			}
+		})
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "room"+journalExt)
+	j, _, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	for i, content := range []string{"one", "two", "three"} {
+		msg := model.Message{ID: content, Seq: int64(i + 1), Content: content}
+		if err := j.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.Replace(model.Message{ID: "two", Seq: 2, Content: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prune the newest message, as retention would the oldest
+	err = j.compact(func(msgs []model.Message) []model.Message {
+		return msgs[:len(msgs)-1]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.stale != 0 || j.records != 3 {
+		t.Errorf("stale = %d, records = %d, want 0 and 3", j.stale, j.records)
+	}
+	if err := j.Append(model.Message{ID: "four", Seq: j.LastSeq() + 1, Content: "four"}); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	j, msgs, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if got, want := contents(msgs), []string{"one", "edited", "four"}; !slices.Equal(got, want) {
+		t.Errorf("messages = %q, want %q", got, want)
+	}
+	if msgs[2].Seq != 4 {
+		t.Errorf("Seq after pruning = %d, want 4", msgs[2].Seq)
+	}
+	if j.LastSeq() != 4 || j.stale != 0 {
+		t.Errorf("LastSeq() = %d, stale = %d, want 4 and 0", j.LastSeq(), j.stale)
+	}
+}
+
+func contents(msgs []model.Message) []string {
+	var out []string
+	for _, msg := range msgs {
+		out = append(out, msg.Content)
+	}
+	return out
+}
@@ -116,6 +116,29 @@ func main() {
 			fmt.Println("Updated server_config.json")
 		}
 
+		// The admin password is only stored hashed, and must be strong
+		initFlags := flag.NewFlagSet("init", flag.ExitOnError)
+		resetAdmin := initFlags.Bool("reset-admin-password", false, "Set a new admin password")
+		initFlags.Parse(os.Args[2:])
+		if !config.HasAdminPassword() || *resetAdmin {
+			if err := promptAdminPassword(config); err != nil {
+				fmt.Printf("Failed to set admin password: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("Admin password set")
+		} else {
+			fmt.Println("Admin password already set (use ./server init -reset-admin-password to change it)")
+		}
+
+		// Create rooms.json, moving over any rooms listed in the config
+		if _, err := os.Stat("rooms.json"); os.IsNotExist(err) {
+			if err := NewRooms("rooms.json").Load(config); err != nil {
+				fmt.Printf("Failed to create rooms.json: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("Created rooms.json")
+		}
+
 		// Create messages directory
 		if err := os.MkdirAll("messages", 0755); err != nil {
 			fmt.Printf("Failed to create messages directory: %v\n", err)
@@ -124,11 +147,13 @@ func main() {
 		fmt.Println("Created messages/ directory")
 
 		// Create general room if not exists
-		if _, err := os.Stat("messages/general.json"); os.IsNotExist(err) {
-			emptyMsgs := []interface{}{} // Empty array
-			data, _ := json.MarshalIndent(emptyMsgs, "", "  ")
-			os.WriteFile("messages/general.json", data, 0644)
-			fmt.Println("Created messages/general.json")
+		if _, err := os.Stat("messages/general.jsonl"); os.IsNotExist(err) {
+			if _, err := os.Stat("messages/general.json"); os.IsNotExist(err) {
+				os.WriteFile("messages/general.jsonl", nil, 0644)
+				fmt.Println("Created messages/general.jsonl")
+			} else {
+				fmt.Println("messages/general.json will be migrated on first start")
+			}
 		}
 
 		// Create users.json if not exists
@@ -193,9 +218,52 @@ func main() {
 	if err := store.Load(); err != nil {
 		log.Printf("Error loading store: %v", err)
 	}
+	store.StartCompaction(compactInterval)
 
-	hub := NewHub(store, config)
+	sessions := NewSessions("sessions.json", time.Duration(config.SessionTTLHours)*time.Hour)
+	if err := sessions.Load(); err != nil {
+		log.Printf("Error loading sessions: %v", err)
+	}
+	markers := NewReadMarkers("read_markers.json")
+	if err := markers.Load(); err != nil {
+		log.Printf("Error loading read markers: %v", err)
+	}
+	markers.StartFlush(markerFlushInterval)
+	mentions := NewMentions("mentions.json")
+	if err := mentions.Load(); err != nil {
+		log.Printf("Error loading mentions: %v", err)
+	}
+	rooms := NewRooms("rooms.json")
+	if err := rooms.Load(config); err != nil {
+		log.Printf("Error loading rooms: %v", err)
+	}
+	grants := NewGrants("grants.json")
+	if err := grants.Load(); err != nil {
+		log.Printf("Error loading grants: %v", err)
+	}
+	if !config.HasAdminPassword() {
+		log.Println("No admin password is set, so /admin is disabled. Run ./server init to set one.")
+	}
+	bans := NewSanctions("bans.json")
+	if err := bans.Load(config); err != nil {
+		log.Printf("Error loading bans: %v", err)
+	}
+	evasions := NewEvasions("ban_evasion.json")
+	if err := evasions.Load(); err != nil {
+		log.Printf("Error loading ban evasion report: %v", err)
+	}
+	modlog, err := OpenModLog("modlog.jsonl")
+	if err != nil {
+		log.Fatalf("Error opening moderation log: %v", err)
+	}
+	filters := NewFilters("filters.json")
+	if err := filters.Load(); err != nil {
+		log.Printf("Error loading filter rules: %v", err)
+	}
+	hub := NewHub(store, config, sessions, markers, mentions, rooms, grants, bans, evasions, modlog, filters)
 	go hub.Run()
+	hub.StartRetention(retentionInterval)
+	hub.StartExpiry(sanctionExpiryInterval)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -223,24 +291,7 @@ func main() {
 		serveWs(hub, w, r)
 	})
 
-	http.HandleFunc("/api/messages", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*") // Allow CORS
-
-		room := r.URL.Query().Get("room")
-		if room == "" {
-			room = "general"
-		}
-
-		messages := store.GetMessages(room)
-		// Optional: limit query param ?limit=100
-		// For now return all
-
-		if err := json.NewEncoder(w).Encode(messages); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	})
+	registerAPI(hub)
 
 	serverAddr := fmt.Sprintf("%s:%s", config.Host, config.Port)
 	server := &http.Server{Addr: serverAddr}
@@ -262,6 +313,11 @@ func main() {
 	go func() {
 		<-stop
 		fmt.Println("\nShutting down server...")
+		if err := markers.Flush(); err != nil {
+			log.Printf("Failed to save read markers: %v", err)
+		}
+		store.Close()
+		modlog.Close()
 		compressLog()
 		os.Remove("logs/server.log")
 		os.Exit(0)
@@ -281,40 +337,130 @@ func main() {
 
 		switch cmd {
 		case "help":
-			fmt.Println("Available commands: ban <ipid>, kick <ipid>, unban <ipid>, broadcast <msg>, stop")
+			fmt.Println("Available commands: ban <user|ipid|address[/bits]> [duration] [reason], unban <user|ipid|address[/bits]>, banreport, modlog [user|action], mute <user> [duration] [reason], unmute <user>, bans, kick <ipid>, broadcast <msg>, sessions [user], revoke <session_id>, role <user> <role|clear>, stop")
 		case "stop":
 			fmt.Println("Stopping server...")
+			if err := markers.Flush(); err != nil {
+				log.Printf("Failed to save read markers: %v", err)
+			}
 			return
 		case "kick":
 			if len(args) != 1 {
 				fmt.Println("Usage: kick <ipid>")
 				continue
 			}
-			if hub.KickUser(args[0]) {
+			if hub.KickUser(args[0], grantByConsole, "") {
 				fmt.Println("User kicked.")
 			} else {
 				fmt.Println("User not found.")
 			}
-		case "ban":
+		case "ban", "mute":
+			if len(args) < 1 {
+				fmt.Printf("Usage: %s <user|ipid|address[/bits]> [duration] [reason]\n", cmd)
+				continue
+			}
+			sanction, _, err := hub.sanctionOf(cmd, args[0], "")
+			if err == errNoSanctionTarget {
+				fmt.Println("User not found.")
+				continue
+			}
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			sanction.By = grantByConsole
+			sanction.Expires, sanction.Reason = parseSanctionArgs(args[1:])
+			if sanction, err := hub.impose(sanction); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			} else {
+				fmt.Printf("%s %s (%s).\n", sanctionVerb(cmd), sanction.target(), sanction.until())
+			}
+		case "unban", "unmute":
 			if len(args) != 1 {
-				fmt.Println("Usage: ban <ipid>")
+				fmt.Printf("Usage: %s <user|ipid|address[/bits]>\n", cmd)
 				continue
 			}
-			if err := config.Ban(args[0]); err != nil {
-				fmt.Println("Error banning:", err)
+			kind := strings.TrimPrefix(cmd, "un")
+			if lifted, err := hub.lift(kind, args[0], grantByConsole); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			} else if !lifted {
+				fmt.Printf("Not %s.\n", strings.ToLower(sanctionVerb(kind)))
 			} else {
-				fmt.Println("User banned.")
-				hub.KickUser(args[0])
+				fmt.Printf("Lifted the %s.\n", kind)
+			}
+		case "modlog":
+			q := ModLogQuery{Limit: modLogLimit}
+			if len(args) > 0 {
+				q.Any = args[0]
+			}
+			list, total := modlog.Query(q)
+			for _, a := range list {
+				fmt.Println(a.line())
 			}
-		case "unban":
+			fmt.Printf("%d actions recorded.\n", total)
+		case "banreport":
+			list, total := evasions.Recent(banReportLimit)
+			for _, e := range list {
+				fmt.Println(e.line())
+			}
+			fmt.Printf("%d attempts recorded.\n", total)
+		case "bans":
+			list := bans.List("")
+			for _, s := range list {
+				fmt.Printf("%-4s  %-20s by %-16s %s  %s  %s\n", s.Kind, s.target(), s.By,
+					s.Created.Format("2006-01-02 15:04"), s.until(), s.Reason)
+			}
+			if len(list) == 0 {
+				fmt.Println("Nobody is banned or muted.")
+			}
+		case "sessions":
+			username := ""
+			if len(args) > 0 {
+				username = args[0]
+			}
+			list := sessions.List(username)
+			for _, sess := range list {
+				fmt.Printf("%s  %-20s created %s  last seen %s  expires %s\n",
+					sess.ID, sess.Username,
+					sess.Created.Format("2006-01-02 15:04"),
+					sess.LastSeen.Format("2006-01-02 15:04"),
+					sess.Expires.Format("2006-01-02 15:04"))
+			}
+			if len(list) == 0 {
+				fmt.Println("No active sessions.")
+			}
+		case "revoke":
 			if len(args) != 1 {
-				fmt.Println("Usage: unban <ipid>")
+				fmt.Println("Usage: revoke <session_id>")
+				continue
+			}
+			sess, ok := sessions.Revoke(args[0], "")
+			if !ok {
+				fmt.Println("Session not found.")
+				continue
+			}
+			hub.EndSessions([]*Session{sess}, nil)
+			fmt.Println("Session revoked.")
+		case "role":
+			// The only way to appoint the first server owner
+			if len(args) != 2 || (args[1] != "clear" && !validRole(args[1])) {
+				fmt.Println("Usage: role <user> <" + strings.Join(roleOrder, "|") + "|clear>")
+				continue
+			}
+			role := args[1]
+			if role == "clear" {
+				role = ""
+			}
+			user, ok := store.FindUser(args[0])
+			if !ok {
+				fmt.Println("User not found.")
 				continue
 			}
-			if err := config.Unban(args[0]); err != nil {
-				fmt.Println("Error unbanning:", err)
+			if err := store.SetRole(user.Username, role); err != nil {
+				fmt.Println("Error setting role:", err)
 			} else {
-				fmt.Println("User unbanned.")
+				hub.recordGrant(Grant{Username: user.Username, Role: role, By: grantByConsole})
+				fmt.Println("Role updated.")
 			}
 		case "broadcast":
 			if len(args) < 1 {
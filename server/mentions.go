@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+const (
+	// maxMentions is how many users one message can mention.
+	maxMentions = 10
+
+	// maxInboxSize is how many unread mentions are kept per user; older
+	// ones are dropped first.
+	maxInboxSize = 100
+)
+
+// mentionPattern matches @name. Trailing punctuation is trimmed after.
+var mentionPattern = regexp.MustCompile(`@([^\s@]+)`)
+
+// Mention is an entry in a user's mention inbox.
+type Mention struct {
+	MessageID string    `json:"message_id"`
+	Room      string    `json:"room"`
+	Sender    string    `json:"sender"`
+	Time      time.Time `json:"time"`
+}
+
+// Mentions keeps the mentions users missed because they were offline or
+// in another room.
+type Mentions struct {
+	inbox map[string][]Mention // Key: Username
+	mu    sync.RWMutex
+	file  string
+}
+
+func NewMentions(file string) *Mentions {
+	return &Mentions{
+		inbox: make(map[string][]Mention),
+		file:  file,
+	}
+}
+
+func (m *Mentions) Load() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, err := os.ReadFile(m.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &m.inbox)
+}
+
+// Helper to save the inboxes without locking (must be called with lock held)
+func (m *Mentions) saveInternal() error {
+	data, err := json.MarshalIndent(m.inbox, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.file, data, 0644)
+}
+
+// Add puts a mention in the inbox of each of usernames.
+func (m *Mentions) Add(mention Mention, usernames ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, username := range usernames {
+		inbox := append(m.inbox[username], mention)
+		if len(inbox) > maxInboxSize {
+			inbox = inbox[len(inbox)-maxInboxSize:]
+		}
+		m.inbox[username] = inbox
+	}
+	return m.saveInternal()
+}
+
+// Count returns how many mentions are waiting for username.
+func (m *Mentions) Count(username string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.inbox[username])
+}
+
+// Take empties username's inbox and returns what was in it, oldest first.
+func (m *Mentions) Take(username string) ([]Mention, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inbox := m.inbox[username]
+	if len(inbox) == 0 {
+		return nil, nil
+	}
+	delete(m.inbox, username)
+	return inbox, m.saveInternal()
+}
+
+// RenameRoom updates the mentions waiting in room old to name room new.
+func (m *Mentions) RenameRoom(old, new string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, inbox := range m.inbox {
+		for i := range inbox {
+			if inbox[i].Room == old {
+				inbox[i].Room = new
+			}
+		}
+	}
+	return m.saveInternal()
+}
+
+// findMentions returns the usernames @mentioned in content, looked up by
+// username or display name. The sender and users who can't read room are
+// left out.
+func (h *Hub) findMentions(content, room, sender string) []string {
+	var found []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		name := strings.TrimRight(match[1], ".,!?:;)'\"")
+		user, ok := h.store.FindUser(name)
+		if !ok || user.Username == sender || seen[user.Username] || !h.CanReadRoom(user, room) {
+			continue
+		}
+		seen[user.Username] = true
+		found = append(found, user.Username)
+		if len(found) == maxMentions {
+			break
+		}
+	}
+	return found
+}
+
+// notifyMentions handles the users mentioned in msg who aren't in its room
+// to see it: the mention goes to their inbox, and any connections they
+// have elsewhere are told right away.
+func (h *Hub) notifyMentions(msg model.Message) {
+	if len(msg.Mentions) == 0 {
+		return
+	}
+	bytes, err := model.EncodeEvent(model.EventMention, msg)
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	inRoom := make(map[string]bool)
+	for client := range h.clients {
+		if client.user != nil && client.subs[msg.Room] {
+			inRoom[client.user.Username] = true
+		}
+	}
+	var away []string
+	for _, username := range msg.Mentions {
+		if inRoom[username] {
+			continue
+		}
+		away = append(away, username)
+		for client := range h.clients {
+			if client.user != nil && client.user.Username == username {
+				h.sendInternal(client, bytes)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	// Saved once the hub is free again
+	if len(away) == 0 {
+		return
+	}
+	mention := Mention{MessageID: msg.ID, Room: msg.Room, Sender: msg.Sender, Time: msg.Timestamp}
+	if err := h.mentions.Add(mention, away...); err != nil {
+		log.Printf("Failed to save mentions for %s: %v", strings.Join(away, ", "), err)
+	}
+}
+
+// sendMentionCount tells a client that just logged in about waiting
+// mentions.
+func (c *Client) sendMentionCount() {
+	if n := c.hub.mentions.Count(c.user.Username); n > 0 {
+		c.sendSystemMessage(fmt.Sprintf("You were mentioned %d time(s) while away. Use /mentions to read them.", n))
+	}
+}
+
+func (c *Client) handleMentions(args []string) {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
+		return
+	}
+	inbox, err := c.hub.mentions.Take(c.user.Username)
+	if err != nil {
+		log.Printf("Failed to save mentions for %s: %v", c.user.Username, err)
+	}
+	if len(inbox) == 0 {
+		c.sendSystemMessage("No new mentions.")
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Mentions (%d):\n", len(inbox)))
+	for _, mention := range inbox {
+		msg, ok := c.hub.store.GetMessage(mention.MessageID)
+		if !ok || msg.Deleted || !c.hub.CanReadMessage(c.user, msg) {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("• [%s] %s in %s: %s (#%s)\n",
+			mention.Time.Format("01/02 15:04"), mention.Sender, mention.Room, msg.Content, msg.ID[:6]))
+	}
+	c.sendSystemMessage(sb.String())
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+// Moderation actions, as recorded in ModAction.
+const (
+	ModKick          = "kick"      // From the server
+	ModRoomKick      = "room.kick" // From one room
+	ModBan           = "ban"
+	ModUnban         = "unban"
+	ModMute          = "mute"
+	ModUnmute        = "unmute"
+	ModRoleSet       = "role.set" // Including admin elevation with the password
+	ModDeleteMessage = "message.delete"
+	ModFlagMessage   = "message.flag" // By the message filter
+	ModClanCreate    = "clan.create"
+	ModClanAdd       = "clan.add"
+	ModClanRemove    = "clan.remove"
+	ModRoomCreate    = "room.create"
+	ModRoomRemove    = "room.remove"
+	ModRoomRename    = "room.rename"
+	ModRoomArchive   = "room.archive"
+	ModRoomRestore   = "room.restore"
+	ModFilterAdd     = "filter.add"
+	ModFilterRemove  = "filter.remove"
+)
+
+const (
+	// modLogLimit is how many entries /modlog shows unless asked for more.
+	modLogLimit = 20
+
+	// maxModLogQuery is the most entries one query returns.
+	maxModLogQuery = 500
+)
+
+// ModAction is one entry of the moderation log: who did what to whom,
+// when and why.
+type ModAction struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"` // Username, grantByConsole, floodProtection or filterActor
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"` // User, address, room or clan acted on
+	Room   string    `json:"room,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Detail string    `json:"detail,omitempty"` // Such as how long a ban lasts, or a new role
+	Addr   string    `json:"addr,omitempty"`   // Remote address of the actor
+}
+
+// ModLog is the moderation log. It is kept apart from the chat history
+// and server log, in modlog.jsonl, one JSON object per line. Entries are
+// only ever appended.
+type ModLog struct {
+	actions []ModAction
+	file    *os.File
+	mu      sync.RWMutex
+}
+
+// OpenModLog opens (or creates) the log at path and reads what it holds.
+// Lines that can't be read, such as one torn by a crash, are skipped.
+func OpenModLog(path string) (*ModLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	m := &ModLog{file: f}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var action ModAction
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			log.Printf("Skipping unreadable line in %s: %v", path, err)
+			continue
+		}
+		m.actions = append(m.actions, action)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Finish a line torn by a crash, so the next entry starts on its own
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			f.Write([]byte{'\n'})
+		}
+	}
+	return m, nil
+}
+
+// Add appends an action to the log.
+func (m *ModLog) Add(action ModAction) error {
+	if action.Time.IsZero() {
+		action.Time = time.Now()
+	}
+	data, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	m.actions = append(m.actions, action)
+	return nil
+}
+
+// ModLogQuery picks entries of the log. Empty fields match everything.
+type ModLogQuery struct {
+	Actor  string
+	Target string
+	Action string // An action, or its prefix before the dot, like "room"
+	Any    string // Matches the actor, the target or the action
+	Since  time.Time
+	Limit  int
+}
+
+// matches reports whether action is one q asks for.
+func (q ModLogQuery) matches(action ModAction) bool {
+	if q.Actor != "" && !strings.EqualFold(action.Actor, q.Actor) {
+		return false
+	}
+	if q.Target != "" && !strings.EqualFold(action.Target, q.Target) {
+		return false
+	}
+	if q.Action != "" && !isAction(action.Action, q.Action) {
+		return false
+	}
+	if q.Any != "" && !strings.EqualFold(action.Actor, q.Any) && !strings.EqualFold(action.Target, q.Any) && !isAction(action.Action, q.Any) {
+		return false
+	}
+	return !action.Time.Before(q.Since)
+}
+
+// isAction reports whether action is want, or one of its kind: "room"
+// covers "room.kick" and the other room actions.
+func isAction(action, want string) bool {
+	return action == want || strings.HasPrefix(action, want+".")
+}
+
+// Query returns the latest entries q asks for, oldest first, and how many
+// matched in all.
+func (m *ModLog) Query(q ModLogQuery) ([]ModAction, int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if q.Limit <= 0 || q.Limit > maxModLogQuery {
+		q.Limit = maxModLogQuery
+	}
+	var list []ModAction
+	total := 0
+	for i := len(m.actions) - 1; i >= 0; i-- {
+		if !q.matches(m.actions[i]) {
+			continue
+		}
+		total++
+		if len(list) < q.Limit {
+			list = append(list, m.actions[i])
+		}
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, total
+}
+
+func (m *ModLog) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.file.Close()
+}
+
+// recordAction adds an action to the moderation log.
+func (h *Hub) recordAction(action ModAction) {
+	if err := h.modlog.Add(action); err != nil {
+		log.Printf("Failed to write moderation log (%s by %s): %v", action.Action, action.Actor, err)
+	}
+}
+
+// recordAction adds an action the client's user took to the moderation
+// log.
+func (c *Client) recordAction(action, target, room, reason, detail string) {
+	c.hub.recordAction(ModAction{
+		Actor:  c.user.Username,
+		Action: action,
+		Target: target,
+		Room:   room,
+		Reason: reason,
+		Detail: detail,
+		Addr:   c.addr,
+	})
+}
+
+// line describes the entry on one line.
+func (a ModAction) line() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s %s %s", a.Time.Format("2006-01-02 15:04"), a.Actor, a.Action))
+	if a.Target != "" {
+		sb.WriteString(" " + a.Target)
+	}
+	if a.Room != "" {
+		sb.WriteString(" in " + a.Room)
+	}
+	if a.Detail != "" {
+		sb.WriteString(" (" + a.Detail + ")")
+	}
+	if a.Reason != "" {
+		sb.WriteString(": " + a.Reason)
+	}
+	return sb.String()
+}
+
+// handleModLog shows the latest moderation actions, optionally only those
+// by or against a user, or of a kind of action: /modlog [user|action] [count]
+func (c *Client) handleModLog(args []string) {
+	if !c.require(PermModLog, "") {
+		return
+	}
+	if len(args) > 2 {
+		c.sendSystemMessage("Usage: /modlog [user|action] [count]")
+		return
+	}
+	q := ModLogQuery{Limit: modLogLimit}
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+			q.Limit = n
+		} else if q.Any == "" {
+			q.Any = arg
+		} else {
+			c.sendSystemMessage("Usage: /modlog [user|action] [count]")
+			return
+		}
+	}
+
+	list, total := c.hub.modlog.Query(q)
+	if len(list) == 0 {
+		c.sendSystemMessage("No moderation actions recorded.")
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Moderation log (%d of %d):\n", len(list), total))
+	for _, a := range list {
+		sb.WriteString("• " + a.line() + "\n")
+	}
+	c.sendSystemMessage(sb.String())
+}
+
+// GET /api/modlog[?actor=<user>][&target=<name>][&action=<action>][&since=<RFC 3339 time>][&limit=<n>]
+func (h *Hub) serveModLog(w http.ResponseWriter, r *http.Request, user *model.User) {
+	if !h.can(user, PermModLogAPI, "") {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	q := ModLogQuery{
+		Actor:  query.Get("actor"),
+		Target: query.Get("target"),
+		Action: query.Get("action"),
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		q.Since = since
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+	list, total := h.modlog.Query(q)
+	if list == nil {
+		list = []ModAction{}
+	}
+	writeJSON(w, struct {
+		Actions []ModAction `json:"actions"`
+		Total   int         `json:"total"`
+	}{list, total})
+}
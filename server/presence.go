@@ -0,0 +1,251 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+const (
+	// idleAfter is how long a connection can go without sending anything
+	// before its user is shown as idle.
+	idleAfter = 5 * time.Minute
+
+	// presenceCheckInterval is how often the hub looks for idle connections.
+	presenceCheckInterval = 30 * time.Second
+)
+
+// roomName is the client's active room, where chat text is posted.
+func (c *Client) roomName() string {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	return c.roomNameInternal()
+}
+
+// roomNameInternal is roomName for callers holding the lock.
+func (c *Client) roomNameInternal() string {
+	if c.Room == "" {
+		return "general"
+	}
+	return c.Room
+}
+
+// memberCountInternal counts the users logged in to room, not counting
+// the connection except. Must be called with lock held.
+func (h *Hub) memberCountInternal(room string, except *Client) int {
+	users := make(map[string]bool)
+	for client := range h.clients {
+		if client != except && client.user != nil && client.subs[room] {
+			users[client.user.Username] = true
+		}
+	}
+	return len(users)
+}
+
+// inRoomInternal reports whether username has a connection other than
+// except in room. Must be called with lock held.
+func (h *Hub) inRoomInternal(username, room string, except *Client) bool {
+	for client := range h.clients {
+		if client != except && client.user != nil && client.user.Username == username && client.subs[room] {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverInternal queues an encoded event for every connection in room.
+// Connections that can't keep up are dropped. Must be called with lock
+// held.
+func (h *Hub) deliverInternal(room string, data []byte) {
+	if room == "" {
+		room = "general"
+	}
+	for client := range h.clients {
+		if client.subs[room] {
+			h.sendInternal(client, data)
+		}
+	}
+}
+
+// sendEventInternal is sendInternal for an event not yet encoded. Must be
+// called with lock held.
+func (h *Hub) sendEventInternal(client *Client, t model.EventType, payload interface{}) bool {
+	data, err := model.EncodeEvent(t, payload)
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return false
+	}
+	return h.sendInternal(client, data)
+}
+
+// sendInternal queues an encoded event for client without waiting. A
+// connection that can't keep up, or was already dropped, doesn't get it;
+// it reports whether the event was queued. Must be called with lock held.
+func (h *Hub) sendInternal(client *Client, data []byte) bool {
+	if !h.clients[client] {
+		return false
+	}
+	select {
+	case client.send <- data:
+		return true
+	default:
+		close(client.send)
+		delete(h.clients, client)
+		return false
+	}
+}
+
+// announceInternal tells everyone in room about a presence change of c's
+// user. If leaving is set c is no longer counted as a member. Must be
+// called with lock held.
+func (h *Hub) announceInternal(c *Client, room, state string, leaving bool) {
+	except := (*Client)(nil)
+	if leaving {
+		except = c
+	}
+	payload := model.PresencePayload{
+		Room:        room,
+		User:        c.user.Username,
+		DisplayName: c.user.DisplayName,
+		State:       state,
+		Members:     h.memberCountInternal(room, except),
+	}
+	if state == model.PresenceAway {
+		payload.Message = c.awayMessage
+	}
+	data, err := model.EncodeEvent(model.EventPresence, payload)
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	h.deliverInternal(room, data)
+}
+
+// announceAllInternal announces a presence change in every room c is in.
+// Must be called with lock held.
+func (h *Hub) announceAllInternal(c *Client, state string) {
+	for _, room := range c.subscriptionsInternal() {
+		h.announceInternal(c, room, state, false)
+	}
+}
+
+// enterRoom announces that c's user is now in the rooms c is in.
+func (h *Hub) enterRoom(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c.user == nil {
+		return
+	}
+	c.lastActive = time.Now()
+	c.idle = false
+	for _, room := range c.subscriptionsInternal() {
+		h.enterInternal(c, room)
+	}
+}
+
+// enterInternal announces that c's user is in room. If they already had a
+// connection there, only c is told the member count. Must be called with
+// lock held.
+func (h *Hub) enterInternal(c *Client, room string) {
+	if c.user == nil {
+		return
+	}
+	if !h.inRoomInternal(c.user.Username, room, c) {
+		h.announceInternal(c, room, model.PresenceJoin, false)
+		return
+	}
+	h.sendEventInternal(c, model.EventPresence, model.PresencePayload{
+		Room:        room,
+		User:        c.user.Username,
+		DisplayName: c.user.DisplayName,
+		State:       model.PresenceActive,
+		Members:     h.memberCountInternal(room, nil),
+	})
+}
+
+// leaveRoom announces that c's user left the rooms c is in, except those
+// they are still in on another connection.
+func (h *Hub) leaveRoom(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leaveRoomInternal(c)
+}
+
+// leaveRoomInternal is leaveRoom for callers holding the lock.
+func (h *Hub) leaveRoomInternal(c *Client) {
+	for _, room := range c.subscriptionsInternal() {
+		h.leaveInternal(c, room)
+	}
+}
+
+// leaveInternal announces that c's user left room, unless they are still
+// there on another connection. Must be called with lock held.
+func (h *Hub) leaveInternal(c *Client, room string) {
+	if c.user == nil || h.inRoomInternal(c.user.Username, room, c) {
+		return
+	}
+	h.announceInternal(c, room, model.PresenceLeave, true)
+}
+
+// markActive records activity on c, bringing its user back from idle.
+func (h *Hub) markActive(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c.lastActive = time.Now()
+	if !c.idle {
+		return
+	}
+	c.idle = false
+	if c.user != nil && !c.away {
+		h.announceAllInternal(c, model.PresenceActive)
+	}
+}
+
+// setAway marks c's user as away with an optional message, or back.
+func (h *Hub) setAway(c *Client, away bool, message string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c.away = away
+	c.awayMessage = message
+	c.lastActive = time.Now()
+	c.idle = false
+	if c.user == nil {
+		return
+	}
+	if away {
+		h.announceAllInternal(c, model.PresenceAway)
+	} else {
+		h.announceAllInternal(c, model.PresenceActive)
+	}
+}
+
+// checkIdleInternal marks connections that have been quiet for idleAfter
+// as idle. Must be called with lock held.
+func (h *Hub) checkIdleInternal(now time.Time) {
+	for client := range h.clients {
+		if client.user == nil || client.idle || now.Sub(client.lastActive) < idleAfter {
+			continue
+		}
+		client.idle = true
+		if !client.away {
+			h.announceAllInternal(client, model.PresenceIdle)
+		}
+	}
+}
+
+// presenceStatus describes c's state for member lists.
+func (c *Client) presenceStatus() string {
+	switch {
+	case c.away && c.awayMessage != "":
+		return "away: " + c.awayMessage
+	case c.away:
+		return "away"
+	case c.idle:
+		return "idle"
+	}
+	return ""
+}
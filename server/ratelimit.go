@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+// floodProtection is who automatic mutes are by, in bans.json and the
+// moderation log.
+const floodProtection = "(flood protection)"
+
+const (
+	// floodStrikeWindow is how long after the last dropped event a user's
+	// warnings are forgotten.
+	floodStrikeWindow = 10 * time.Minute
+
+	// rateSweepInterval is how often buckets that filled up again are
+	// dropped.
+	rateSweepInterval = time.Minute
+)
+
+// RateLimit is a token bucket: up to Burst events at once, refilled at
+// PerMinute. A PerMinute of 0 turns the limit off.
+type RateLimit struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     int     `json:"burst"`
+}
+
+// RateLimits are the flood limits in the server config. Each limit applies
+// separately to every connection, every account and every remote address,
+// except Events, which applies to connections only.
+type RateLimits struct {
+	Messages RateLimit `json:"messages"` // Chat text
+	Commands RateLimit `json:"commands"` // Lines starting with /
+	Logins   RateLimit `json:"logins"`   // /login and /register
+	Events   RateLimit `json:"events"`   // Typing and read markers
+
+	// Dropped messages or commands a user is warned about before being
+	// muted for MuteMinutes. 0 only warns.
+	WarningsBeforeMute int `json:"warnings_before_mute"`
+	MuteMinutes        int `json:"mute_minutes"`
+}
+
+var defaultRateLimits = RateLimits{
+	Messages:           RateLimit{PerMinute: 30, Burst: 8},
+	Commands:           RateLimit{PerMinute: 60, Burst: 15},
+	Logins:             RateLimit{PerMinute: 6, Burst: 10},
+	Events:             RateLimit{PerMinute: 120, Burst: 20},
+	WarningsBeforeMute: 3,
+	MuteMinutes:        10,
+}
+
+// tokenBucket is the state of one bucket.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Minutes() * b.limit.PerMinute
+	if max := float64(b.limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// wait is how long until the bucket has a token.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.PerMinute * float64(time.Minute))
+}
+
+// floodStrike counts the dropped events of one user.
+type floodStrike struct {
+	count int
+	last  time.Time
+}
+
+// RateLimiter keeps the token buckets behind the flood limits, and the
+// warnings given to users who ran into them.
+type RateLimiter struct {
+	buckets   map[string]*tokenBucket // Key: kind + ":" + rateKeys
+	strikes   map[string]*floodStrike // Key: username
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		strikes: make(map[string]*floodStrike),
+	}
+}
+
+// Take uses up a token of kind from the bucket of every key, if they all
+// have one. Otherwise nothing is taken, and it returns how long until they
+// do.
+func (r *RateLimiter) Take(kind string, limit RateLimit, keys []string) (time.Duration, bool) {
+	if limit.PerMinute <= 0 {
+		return 0, true
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.sweepInternal(now)
+	var buckets []*tokenBucket
+	var wait time.Duration
+	for _, key := range keys {
+		b, ok := r.buckets[kind+":"+key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+			r.buckets[kind+":"+key] = b
+		}
+		b.limit = limit
+		b.refill(now)
+		if w := b.wait(); w > wait {
+			wait = w
+		}
+		buckets = append(buckets, b)
+	}
+	if wait > 0 {
+		return wait, false
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, true
+}
+
+// Strike records a dropped event of username and returns how many there
+// were since the user last went floodStrikeWindow without one.
+func (r *RateLimiter) Strike(username string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	s, ok := r.strikes[username]
+	if !ok || now.Sub(s.last) > floodStrikeWindow {
+		s = &floodStrike{}
+		r.strikes[username] = s
+	}
+	s.count++
+	s.last = now
+	return s.count
+}
+
+// Forgive forgets the warnings given to username.
+func (r *RateLimiter) Forgive(username string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.strikes, username)
+}
+
+// sweepInternal drops the buckets that filled up again and the warnings
+// that were forgotten, now and then. Must be called with lock held.
+func (r *RateLimiter) sweepInternal(now time.Time) {
+	if now.Sub(r.lastSweep) < rateSweepInterval {
+		return
+	}
+	r.lastSweep = now
+	for key, b := range r.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+	for username, s := range r.strikes {
+		if now.Sub(s.last) > floodStrikeWindow {
+			delete(r.strikes, username)
+		}
+	}
+}
+
+// rateKeys names the connection, its account and its address, each of
+// which has its own buckets. The connection comes first.
+func (c *Client) rateKeys() []string {
+	keys := []string{fmt.Sprintf("conn:%p", c)}
+	if c.user != nil {
+		keys = append(keys, "user:"+c.user.Username)
+	}
+	if c.addr != "" {
+		keys = append(keys, "addr:"+c.addr)
+	}
+	return keys
+}
+
+// checkRate tells the client and returns false if it is sending chat text
+// or commands faster than the limits allow. Users who keep at it are
+// muted for a while.
+func (c *Client) checkRate(content string) bool {
+	limits := c.hub.config.Limits()
+	kind, limit := "message", limits.Messages
+	if strings.HasPrefix(content, "/") {
+		kind, limit = "command", limits.Commands
+	}
+	wait, ok := c.hub.limiter.Take(kind, limit, c.rateKeys())
+	if ok {
+		return true
+	}
+
+	payload := model.RateLimitPayload{
+		Kind:       kind,
+		RetryAfter: retrySeconds(wait),
+		Message:    fmt.Sprintf("You are sending too fast. Wait %ds before sending again.", retrySeconds(wait)),
+	}
+	// Moderators and above are slowed down but never muted
+	if c.user == nil || limits.WarningsBeforeMute <= 0 || c.can(PermMute, "") {
+		c.sendEvent(model.EventRateLimited, payload)
+		return false
+	}
+	if _, muted := c.hub.bans.Active(SanctionMute, c.user); muted {
+		c.sendEvent(model.EventRateLimited, payload)
+		return false
+	}
+
+	strikes := c.hub.limiter.Strike(c.user.Username)
+	if strikes <= limits.WarningsBeforeMute {
+		payload.Warning = strikes
+		payload.MuteAfter = limits.WarningsBeforeMute
+		payload.Message += fmt.Sprintf(" (warning %d of %d before you are muted)", strikes, limits.WarningsBeforeMute)
+		c.sendEvent(model.EventRateLimited, payload)
+		return false
+	}
+
+	c.hub.limiter.Forgive(c.user.Username)
+	minutes := limits.MuteMinutes
+	if minutes <= 0 {
+		minutes = defaultRateLimits.MuteMinutes
+	}
+	expires := time.Now().Add(time.Duration(minutes) * time.Minute)
+	if _, err := c.hub.impose(Sanction{
+		Kind:     SanctionMute,
+		Username: c.user.Username,
+		IPID:     c.user.IPID,
+		Reason:   "flooding",
+		By:       floodProtection,
+		Expires:  &expires,
+	}); err != nil {
+		log.Printf("Failed to mute %s for flooding: %v", c.user.Username, err)
+	}
+	return false
+}
+
+// checkEventRate reports whether the connection may send another typing
+// or read event. Events past the limit are dropped quietly: the user misses
+// nothing, so there is nothing to warn about.
+func (c *Client) checkEventRate() bool {
+	_, ok := c.hub.limiter.Take("event", c.hub.config.Limits().Events, c.rateKeys()[:1])
+	return ok
+}
+
+// checkLoginRate tells the client and returns false if too many logins
+// were tried from its connection or address. Tries aren't counted against
+// the account named, or anyone could lock its owner out.
+func (c *Client) checkLoginRate(username string) bool {
+	wait, ok := c.hub.limiter.Take("login", c.hub.config.Limits().Logins, c.rateKeys())
+	if ok {
+		return true
+	}
+	log.Printf("Too many logins for %s from %s", username, c.addr)
+	c.sendEvent(model.EventRateLimited, model.RateLimitPayload{
+		Kind:       "login",
+		RetryAfter: retrySeconds(wait),
+		Message:    fmt.Sprintf("Too many login attempts. Try again in %ds.", retrySeconds(wait)),
+	})
+	return false
+}
+
+// retrySeconds rounds a wait up to whole seconds.
+func retrySeconds(wait time.Duration) int {
+	return int(wait.Seconds() + 0.999)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxReactions is how many different emoji one message can collect.
+const maxReactions = 20
+
+// shortcodes maps the :names: accepted by /react to their emoji.
+var shortcodes = map[string]string{
+	":+1:":       "👍",
+	":thumbsup:": "👍",
+	":-1:":       "👎",
+	":heart:":    "❤️",
+	":joy:":      "😂",
+	":smile:":    "😄",
+	":cry:":      "😢",
+	":thinking:": "🤔",
+	":tada:":     "🎉",
+	":eyes:":     "👀",
+	":fire:":     "🔥",
+	":clap:":     "👏",
+	":wave:":     "👋",
+	":ok:":       "👌",
+	":rocket:":   "🚀",
+	":100:":      "💯",
+}
+
+// parseReaction turns the argument of /react into the emoji to store. It
+// accepts a shortcode or a single emoji, but no words.
+func parseReaction(arg string) (string, error) {
+	if emoji, ok := shortcodes[strings.ToLower(arg)]; ok {
+		return emoji, nil
+	}
+	if strings.HasPrefix(arg, ":") && strings.HasSuffix(arg, ":") {
+		return "", fmt.Errorf("unknown shortcode %s", arg)
+	}
+	// Emoji can be a few code points long (skin tones, ZWJ sequences)
+	if utf8.RuneCountInString(arg) > 8 {
+		return "", fmt.Errorf("a reaction must be a single emoji")
+	}
+	for _, r := range arg {
+		if r < utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsSpace(r) {
+			return "", fmt.Errorf("a reaction must be a single emoji")
+		}
+	}
+	return arg, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+// ReadMarker is the last message a user has read in a room.
+type ReadMarker struct {
+	ID  string `json:"id"`
+	Seq int64  `json:"seq"`
+}
+
+// markerFlushInterval is how often markers that moved are saved. Markers
+// move with nearly every message read, so they aren't saved each time.
+const markerFlushInterval = 10 * time.Second
+
+// ReadMarkers keeps every user's read position in each room.
+type ReadMarkers struct {
+	marks map[string]map[string]ReadMarker // Key: Username, then Room
+	dirty bool                             // Markers moved since the last save
+	mu    sync.RWMutex
+	file  string
+}
+
+func NewReadMarkers(file string) *ReadMarkers {
+	return &ReadMarkers{
+		marks: make(map[string]map[string]ReadMarker),
+		file:  file,
+	}
+}
+
+func (r *ReadMarkers) Load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := os.ReadFile(r.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &r.marks)
+}
+
+// Helper to save markers without locking (must be called with lock held)
+func (r *ReadMarkers) saveInternal() error {
+	data, err := json.MarshalIndent(r.marks, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.file, data, 0644); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+// Flush saves the markers if any moved since they were last saved.
+func (r *ReadMarkers) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.dirty {
+		return nil
+	}
+	return r.saveInternal()
+}
+
+// StartFlush saves markers that moved every interval. It runs until the
+// process exits; call Flush before exiting.
+func (r *ReadMarkers) StartFlush(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := r.Flush(); err != nil {
+				log.Printf("Failed to save read markers: %v", err)
+			}
+		}
+	}()
+}
+
+// Get returns username's marker in room.
+func (r *ReadMarkers) Get(username, room string) (ReadMarker, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	marker, ok := r.marks[username][room]
+	return marker, ok
+}
+
+// Mark moves username's marker in room forward to marker. It reports
+// whether the marker moved; markers never go back. The change is saved by
+// the next Flush.
+func (r *ReadMarkers) Mark(username, room string, marker ReadMarker) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if current, ok := r.marks[username][room]; ok && current.Seq >= marker.Seq {
+		return false
+	}
+	if r.marks[username] == nil {
+		r.marks[username] = make(map[string]ReadMarker)
+	}
+	r.marks[username][room] = marker
+	r.dirty = true
+	return true
+}
+
+// RenameRoom moves every marker in room old to room new.
+func (r *ReadMarkers) RenameRoom(old, new string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rooms := range r.marks {
+		if marker, ok := rooms[old]; ok {
+			rooms[new] = marker
+			delete(rooms, old)
+		}
+	}
+	return r.saveInternal()
+}
+
+// DropRoom forgets every marker in room.
+func (r *ReadMarkers) DropRoom(room string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rooms := range r.marks {
+		delete(rooms, room)
+	}
+	return r.saveInternal()
+}
+
+// Start gives a user seen for the first time a marker at the end of each
+// room, so old history doesn't all count as unread. Rooms created later
+// start out unread. It does nothing for users who already have markers.
+func (r *ReadMarkers) Start(username string, latest map[string]ReadMarker) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.marks[username]; ok {
+		return nil
+	}
+	r.marks[username] = latest
+	return r.saveInternal()
+}
+
+// roomUnread works out how many messages in room username hasn't read.
+func (h *Hub) roomUnread(username, room string) model.RoomUnread {
+	marker, _ := h.markers.Get(username, room)
+	unread := model.RoomUnread{LastRead: marker.ID}
+	if last, ok := h.store.LastMessage(room); ok && last.Seq > marker.Seq {
+		unread.Count = int(last.Seq - marker.Seq)
+	}
+	return unread
+}
+
+// sendUnread sends the client the unread counts of every room its user
+// can read. It is called once the client has logged in.
+func (c *Client) sendUnread() {
+	if c.user == nil {
+		return
+	}
+	rooms := make(map[string]model.RoomUnread)
+	latest := make(map[string]ReadMarker)
+	for _, room := range c.hub.rooms.Names() {
+		if !c.hub.CanReadRoom(c.user, room) {
+			continue
+		}
+		if last, ok := c.hub.store.LastMessage(room); ok {
+			latest[room] = ReadMarker{ID: last.ID, Seq: last.Seq}
+		}
+	}
+	if err := c.hub.markers.Start(c.user.Username, latest); err != nil {
+		log.Printf("Failed to save read markers: %v", err)
+	}
+	for room := range latest {
+		rooms[room] = c.hub.roomUnread(c.user.Username, room)
+	}
+	c.sendEvent(model.EventUnread, model.UnreadPayload{Rooms: rooms, Full: true})
+}
+
+// markRead moves the client's read marker in a room forward and tells all
+// of the user's connections the new count.
+func (c *Client) markRead(payload model.ReadPayload) {
+	if c.user == nil || !c.hub.CanReadRoom(c.user, payload.Room) {
+		return
+	}
+	msg, ok := c.hub.store.GetMessage(payload.MessageID)
+	if !ok || msg.Room != payload.Room || msg.Recipient != "" {
+		return
+	}
+	c.hub.advanceMarker(c.user.Username, msg)
+}
+
+// advanceMarker marks msg as read by username and, if that changed
+// anything, sends the new count to their connections.
+func (h *Hub) advanceMarker(username string, msg model.Message) {
+	if !h.markers.Mark(username, msg.Room, ReadMarker{ID: msg.ID, Seq: msg.Seq}) {
+		return
+	}
+	bytes, err := model.EncodeEvent(model.EventUnread, model.UnreadPayload{
+		Rooms: map[string]model.RoomUnread{msg.Room: h.roomUnread(username, msg.Room)},
+	})
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	h.sendToUser(username, bytes)
+}
+
+// notifyUnread sends the new unread count of room to everyone who can read
+// it, after sender posted a message there.
+func (h *Hub) notifyUnread(room, sender string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	encoded := make(map[string][]byte) // Key: Username
+	for client := range h.clients {
+		if client.user == nil || client.user.Username == sender {
+			continue
+		}
+		username := client.user.Username
+		bytes, ok := encoded[username]
+		if !ok {
+			if h.CanReadRoom(client.user, room) {
+				bytes, _ = model.EncodeEvent(model.EventUnread, model.UnreadPayload{
+					Rooms: map[string]model.RoomUnread{room: h.roomUnread(username, room)},
+				})
+			}
+			encoded[username] = bytes
+		}
+		if bytes == nil {
+			continue
+		}
+		select {
+		case client.send <- bytes:
+		default:
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+// Roles, from least to most trusted. A user's server-wide role is kept on
+// the user; rooms can give them a different role inside the room.
+const (
+	RoleGuest     = "guest"     // Read only
+	RoleMember    = "member"    // Everyone who registered
+	RoleModerator = "moderator" // Keeps the peace
+	RoleAdmin     = "admin"     // Runs the server
+	RoleOwner     = "owner"     // Owns the server, or the room
+)
+
+// roleOrder lists the roles by rank.
+var roleOrder = []string{RoleGuest, RoleMember, RoleModerator, RoleAdmin, RoleOwner}
+
+// Permission is something a role allows.
+type Permission string
+
+const (
+	PermPost        Permission = "message.post"   // Send messages
+	PermDeleteAny   Permission = "message.delete" // Delete other users' messages
+	PermKick        Permission = "kick"           // Kick from the server, or from a room
+	PermMute        Permission = "mute"           // Stop someone sending for a while
+	PermBan         Permission = "ban"
+	PermRoomCreate  Permission = "room.create"
+	PermRoomRemove  Permission = "room.remove"
+	PermRoomManage  Permission = "room.manage"   // Topic, settings, invites, rename, archive; no slow mode
+	PermRoomReadAll Permission = "room.read_all" // Read rooms without being a member
+	PermClanManage  Permission = "clan.manage"
+	PermRoleManage  Permission = "role.manage"   // Give others lower roles than one's own
+	PermModLog      Permission = "modlog.read"   // Read the moderation log with /modlog
+	PermModLogAPI   Permission = "modlog.export" // Read the moderation log over the REST API
+
+	PermFilterManage Permission = "filter.manage" // Change the message filter rules
+)
+
+// rolePermissions is what each role allows. Every role also has the
+// permissions of the roles below it.
+var rolePermissions = map[string][]Permission{
+	RoleGuest:     {},
+	RoleMember:    {PermPost},
+	RoleModerator: {PermDeleteAny, PermKick, PermMute, PermModLog},
+	RoleAdmin:     {PermBan, PermRoomCreate, PermRoomRemove, PermRoomManage, PermRoomReadAll, PermClanManage, PermRoleManage, PermModLogAPI, PermFilterManage},
+	RoleOwner:     {},
+}
+
+// roleRank orders roles; unknown roles rank below guest.
+func roleRank(role string) int {
+	for i, r := range roleOrder {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+func validRole(role string) bool {
+	return roleRank(role) >= 0
+}
+
+// atLeast reports whether role ranks as high as min.
+func atLeast(role, min string) bool {
+	return roleRank(role) >= roleRank(min)
+}
+
+// roleAllows reports whether role has perm, itself or through a role
+// below it. Owners may do everything.
+func roleAllows(role string, perm Permission) bool {
+	rank := roleRank(role)
+	for i := 0; i <= rank; i++ {
+		for _, p := range rolePermissions[roleOrder[i]] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return rank == len(roleOrder)-1
+}
+
+// globalRole is user's server-wide role.
+func globalRole(user *model.User) string {
+	if user == nil {
+		return RoleGuest
+	}
+	if user.Role == "" {
+		return RoleMember
+	}
+	return user.Role
+}
+
+// roleIn returns user's role in room: the one the room gives them, or
+// owner for the room's owner, or else their server-wide role. Admins and
+// the server owner keep their own role everywhere. An empty room asks for
+// the server-wide role.
+func (h *Hub) roleIn(user *model.User, room string) string {
+	role := globalRole(user)
+	if room == "" || user == nil || atLeast(role, RoleAdmin) {
+		return role
+	}
+	r, ok := h.rooms.Get(room)
+	if !ok {
+		return role
+	}
+	if roomRole, ok := r.Roles[user.Username]; ok {
+		return roomRole
+	}
+	if r.Owner == user.Username {
+		return RoleOwner
+	}
+	return role
+}
+
+// can reports whether user may do perm in room, or server-wide if room is
+// empty. This is the one place permissions are decided.
+func (h *Hub) can(user *model.User, perm Permission, room string) bool {
+	return user != nil && roleAllows(h.roleIn(user, room), perm)
+}
+
+// can reports whether the client's user may do perm in room.
+func (c *Client) can(perm Permission, room string) bool {
+	return c.hub.can(c.user, perm, room)
+}
+
+// require is can that tells the client when the answer is no.
+func (c *Client) require(perm Permission, room string) bool {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
+		return false
+	}
+	if c.can(perm, room) {
+		return true
+	}
+	if room != "" {
+		c.sendSystemMessage(fmt.Sprintf("You don't have permission to do that in %s (%s).", room, perm))
+	} else {
+		c.sendSystemMessage(fmt.Sprintf("You don't have permission to do that (%s).", perm))
+	}
+	return false
+}
+
+// handleRole manages roles: /role <list|set|clear|perms|history> ...
+func (c *Client) handleRole(args []string) {
+	if c.user == nil {
+		c.sendSystemMessage("Please login first.")
+		return
+	}
+	if len(args) < 1 {
+		c.sendSystemMessage("Usage: /role <list|set|clear|perms|history> ...")
+		return
+	}
+	switch args[0] {
+	case "list":
+		c.handleRoleList(args[1:])
+	case "set":
+		if len(args) != 3 && len(args) != 4 {
+			c.sendSystemMessage("Usage: /role set <user> <role> [room]")
+			return
+		}
+		room := ""
+		if len(args) == 4 {
+			room = args[3]
+		}
+		c.assignRole(args[1], args[2], room)
+	case "clear":
+		if len(args) != 2 && len(args) != 3 {
+			c.sendSystemMessage("Usage: /role clear <user> [room]")
+			return
+		}
+		room := ""
+		if len(args) == 3 {
+			room = args[2]
+		}
+		c.assignRole(args[1], "", room)
+	case "perms":
+		c.handleRolePerms(args[1:])
+	case "history":
+		c.handleRoleHistory(args[1:])
+	default:
+		c.sendSystemMessage("Unknown subcommand.")
+	}
+}
+
+// handleRoleList shows who has a role other than member, server-wide or in
+// a room: /role list [room]
+func (c *Client) handleRoleList(args []string) {
+	if len(args) > 1 {
+		c.sendSystemMessage("Usage: /role list [room]")
+		return
+	}
+	var sb strings.Builder
+	if len(args) == 1 {
+		room, ok := c.hub.rooms.Get(args[0])
+		if !ok || !c.hub.CanReadRoom(c.user, room.Name) {
+			c.sendSystemMessage("Room does not exist.")
+			return
+		}
+		sb.WriteString(fmt.Sprintf("Roles in %s:\n", room.Name))
+		if room.Owner != "" {
+			sb.WriteString(fmt.Sprintf("• %s: %s (room owner)\n", room.Owner, RoleOwner))
+		}
+		names := make([]string, 0, len(room.Roles))
+		for name := range room.Roles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sb.WriteString(fmt.Sprintf("• %s: %s\n", name, room.Roles[name]))
+		}
+		if room.Owner == "" && len(names) == 0 {
+			sb.WriteString("No roles assigned.\n")
+		}
+		c.sendSystemMessage(sb.String())
+		return
+	}
+
+	sb.WriteString("Server roles:\n")
+	count := 0
+	for _, user := range c.hub.store.UsersWithRoles() {
+		sb.WriteString(fmt.Sprintf("• %s: %s\n", user.Username, user.Role))
+		count++
+	}
+	if count == 0 {
+		sb.WriteString("No roles assigned.\n")
+	}
+	sb.WriteString(fmt.Sprintf("Your role: %s", globalRole(c.user)))
+	c.sendSystemMessage(sb.String())
+}
+
+// handleRolePerms shows what roles allow: /role perms [role]
+func (c *Client) handleRolePerms(args []string) {
+	if len(args) > 1 || (len(args) == 1 && !validRole(args[0])) {
+		c.sendSystemMessage("Usage: /role perms [" + strings.Join(roleOrder, "|") + "]")
+		return
+	}
+	roles := roleOrder
+	if len(args) == 1 {
+		roles = args
+	}
+	var sb strings.Builder
+	sb.WriteString("Role permissions:\n")
+	for _, role := range roles {
+		var perms []string
+		for i := 0; i <= roleRank(role); i++ {
+			for _, p := range rolePermissions[roleOrder[i]] {
+				perms = append(perms, string(p))
+			}
+		}
+		if role == RoleOwner {
+			perms = []string{"everything"}
+		}
+		if len(perms) == 0 {
+			perms = []string{"read only"}
+		}
+		sb.WriteString(fmt.Sprintf("• %s: %s\n", role, strings.Join(perms, ", ")))
+	}
+	c.sendSystemMessage(sb.String())
+}
+
+// assignRole gives name the role, server-wide or in room; an empty role
+// takes their role away. Nobody can hand out a role as high as their own,
+// or change the role of someone ranked as high as them, unless they are
+// the server owner. Owning a room doesn't count: room owners are held to
+// the same checks, and can't make anyone admin or owner of the room.
+func (c *Client) assignRole(name, role, room string) {
+	if role != "" && !validRole(role) {
+		c.sendSystemMessage("Role must be one of: " + strings.Join(roleOrder, ", ") + ".")
+		return
+	}
+	if room != "" {
+		if r, ok := c.hub.rooms.Get(room); !ok || !c.hub.CanReadRoom(c.user, r.Name) {
+			c.sendSystemMessage("Room does not exist.")
+			return
+		}
+	}
+	if !c.require(PermRoleManage, room) {
+		return
+	}
+	target, ok := c.hub.store.FindUser(name)
+	if !ok {
+		c.sendSystemMessage("User not found.")
+		return
+	}
+
+	if room != "" && atLeast(globalRole(target), RoleAdmin) {
+		c.sendSystemMessage(fmt.Sprintf("%s is %s and keeps that role in every room.", target.Username, globalRole(target)))
+		return
+	}
+	mine := c.hub.roleIn(c.user, room)
+	if globalRole(c.user) != RoleOwner {
+		if target.Username == c.user.Username {
+			c.sendSystemMessage("You can't change your own role.")
+			return
+		}
+		if atLeast(c.hub.roleIn(target, room), mine) || (role != "" && atLeast(role, mine)) {
+			c.sendSystemMessage(fmt.Sprintf("Only someone ranked above %s can do that.", mine))
+			return
+		}
+		if room != "" && role != "" && atLeast(role, RoleAdmin) {
+			c.sendSystemMessage(fmt.Sprintf("Only the server owner can make someone %s of a room.", role))
+			return
+		}
+	}
+
+	var err error
+	if room == "" {
+		err = c.hub.store.SetRole(target.Username, role)
+	} else {
+		err = c.hub.rooms.SetRole(room, target.Username, role)
+	}
+	if err != nil {
+		c.sendSystemMessage("Failed to set role: " + err.Error())
+		return
+	}
+
+	where := "server-wide"
+	if room != "" {
+		where = "in " + room
+	}
+	shown := role
+	if shown == "" {
+		shown = c.hub.roleIn(target, room)
+	}
+	c.hub.recordGrant(Grant{Username: target.Username, Role: role, Room: room, By: c.user.Username, Addr: c.addr})
+	c.sendSystemMessage(fmt.Sprintf("%s is now %s %s.", target.Username, shown, where))
+	if target.Username != c.user.Username {
+		c.hub.notifyUser(target.Username, fmt.Sprintf("%s made you %s %s.", c.user.Username, shown, where))
+	}
+	log.Printf("User %s set role of %s %s to %q", c.user.Username, target.Username, where, role)
+}
+
+// roleHistoryLimit is how many role changes /role history shows.
+const roleHistoryLimit = 20
+
+// handleRoleHistory shows who gave whom which role: /role history [user]
+func (c *Client) handleRoleHistory(args []string) {
+	if len(args) > 1 {
+		c.sendSystemMessage("Usage: /role history [user]")
+		return
+	}
+	if !c.require(PermRoleManage, "") {
+		return
+	}
+	username := ""
+	if len(args) == 1 {
+		user, ok := c.hub.store.FindUser(args[0])
+		if !ok {
+			c.sendSystemMessage("User not found.")
+			return
+		}
+		username = user.Username
+	}
+
+	grants := c.hub.grants.Recent(username, roleHistoryLimit)
+	if len(grants) == 0 {
+		c.sendSystemMessage("No role changes recorded.")
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("Role changes:\n")
+	for _, g := range grants {
+		role := g.Role
+		if role == "" {
+			role = "(cleared)"
+		}
+		where := "server-wide"
+		if g.Room != "" {
+			where = "in " + g.Room
+		}
+		sb.WriteString(fmt.Sprintf("• %s %s: %s %s by %s", g.Time.Format("2006-01-02 15:04"), g.Username, role, where, g.By))
+		if g.Addr != "" {
+			sb.WriteString(" from " + g.Addr)
+		}
+		sb.WriteString("\n")
+	}
+	c.sendSystemMessage(sb.String())
+}
+
+// recordGrant adds a role change to the record and the moderation log.
+func (h *Hub) recordGrant(grant Grant) {
+	if err := h.grants.Add(grant); err != nil {
+		log.Printf("Error recording role change of %s: %v", grant.Username, err)
+	}
+	action := ModAction{
+		Time:   grant.Time,
+		Actor:  grant.By,
+		Action: ModRoleSet,
+		Target: grant.Username,
+		Room:   grant.Room,
+		Detail: grant.Role,
+		Addr:   grant.Addr,
+	}
+	if action.Detail == "" {
+		action.Detail = "cleared"
+	}
+	if grant.By == grantByPassword {
+		// Admin elevation: the user granted it to themselves
+		action.Actor = grant.Username
+		action.Detail += " " + grantByPassword
+	}
+	h.recordAction(action)
+}
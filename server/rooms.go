@@ -0,0 +1,940 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/puyokura/cmppchat/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Room visibility settings.
+const (
+	RoomPublic     = "public"      // Listed, anyone can join
+	RoomPrivate    = "private"     // Not listed, members only
+	RoomInviteOnly = "invite-only" // Listed, members only
+)
+
+// Room is a chat room and who may use it.
+type Room struct {
+	Name         string   `json:"name"`
+	Owner        string   `json:"owner,omitempty"` // Username, empty for rooms from before owners
+	Visibility   string   `json:"visibility"`
+	PasswordHash string   `json:"password_hash,omitempty"` // Lets non-members of a public or private room join
+	Members      []string `json:"members,omitempty"`       // Usernames let into a room that isn't open
+
+	Roles map[string]string `json:"roles,omitempty"` // Username -> role in this room, overriding their server-wide one
+
+	Topic       string       `json:"topic,omitempty"`
+	Description string       `json:"description,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"` // Zero for rooms from before it was recorded
+	CreatedBy   string       `json:"created_by,omitempty"`
+	Settings    RoomSettings `json:"settings"`
+	Archived    bool         `json:"archived,omitempty"` // Read-only, history can still be read
+}
+
+// RoomSettings limit what can be posted in a room. Zero turns a setting off.
+type RoomSettings struct {
+	MaxMessageLength int `json:"max_message_length,omitempty"` // Characters per message
+	SlowModeSeconds  int `json:"slow_mode_seconds,omitempty"`  // Wait between a user's messages
+	RetentionDays    int `json:"retention_days,omitempty"`     // Older messages are deleted
+}
+
+// Open reports whether anyone can join without being a member.
+func (r *Room) Open() bool {
+	return r.Visibility == RoomPublic && r.PasswordHash == ""
+}
+
+// Listed reports whether the room shows up in /room list for non-members.
+func (r *Room) Listed() bool {
+	return r.Visibility != RoomPrivate
+}
+
+func (r *Room) IsMember(username string) bool {
+	if r.Owner == username {
+		return true
+	}
+	for _, m := range r.Members {
+		if m == username {
+			return true
+		}
+	}
+	return false
+}
+
+// copy returns a copy of the room that shares nothing with it.
+func (r *Room) copy() Room {
+	copied := *r
+	copied.Members = append([]string(nil), r.Members...)
+	if r.Roles != nil {
+		copied.Roles = make(map[string]string, len(r.Roles))
+		for name, role := range r.Roles {
+			copied.Roles[name] = role
+		}
+	}
+	return copied
+}
+
+// CheckPassword reports whether password opens the room.
+func (r *Room) CheckPassword(password string) bool {
+	return r.PasswordHash != "" && bcrypt.CompareHashAndPassword([]byte(r.PasswordHash), []byte(password)) == nil
+}
+
+func validVisibility(v string) bool {
+	return v == RoomPublic || v == RoomPrivate || v == RoomInviteOnly
+}
+
+// Rooms keeps the chat rooms, in the order they were created.
+type Rooms struct {
+	rooms []*Room
+	mu    sync.RWMutex
+	file  string
+}
+
+func NewRooms(file string) *Rooms {
+	return &Rooms{file: file}
+}
+
+// Load reads the rooms. Servers from before rooms.json kept a list of room
+// names in server_config.json; those become public rooms. The general room
+// always exists.
+func (r *Rooms) Load(config *Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := os.ReadFile(r.file)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &r.rooms); err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		config.mu.Lock()
+		for _, name := range config.Rooms {
+			r.rooms = append(r.rooms, &Room{Name: name, Visibility: RoomPublic})
+		}
+		config.Rooms = nil
+		config.mu.Unlock()
+	default:
+		return err
+	}
+
+	if r.getInternal("general") == nil {
+		r.rooms = append([]*Room{{Name: "general", Visibility: RoomPublic}}, r.rooms...)
+	}
+	if err := r.saveInternal(); err != nil {
+		return err
+	}
+	// Only drop the old list once the rooms are safely in rooms.json
+	return config.Save()
+}
+
+// Helper to save rooms without locking (must be called with lock held)
+func (r *Rooms) saveInternal() error {
+	data, err := json.MarshalIndent(r.rooms, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.file, data, 0644)
+}
+
+// getInternal finds a room. Must be called with lock held.
+func (r *Rooms) getInternal(name string) *Room {
+	for _, room := range r.rooms {
+		if room.Name == name {
+			return room
+		}
+	}
+	return nil
+}
+
+// Get returns a copy of the room called name.
+func (r *Rooms) Get(name string) (Room, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	room := r.getInternal(name)
+	if room == nil {
+		return Room{}, false
+	}
+	return room.copy(), true
+}
+
+func (r *Rooms) Exists(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.getInternal(name) != nil
+}
+
+// Names returns the names of all rooms.
+func (r *Rooms) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, len(r.rooms))
+	for i, room := range r.rooms {
+		names[i] = room.Name
+	}
+	return names
+}
+
+// List returns a copy of every room.
+func (r *Rooms) List() []Room {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]Room, len(r.rooms))
+	for i, room := range r.rooms {
+		list[i] = room.copy()
+	}
+	return list
+}
+
+// CanAccess reports whether username may join and read room. readAll
+// lets them into every room.
+func (r *Rooms) CanAccess(name, username string, readAll bool) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	room := r.getInternal(name)
+	if room == nil {
+		return false
+	}
+	return room.Open() || readAll || room.IsMember(username)
+}
+
+// Create adds a new room. A password, if given, is stored hashed.
+func (r *Rooms) Create(name, owner, visibility, password string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.getInternal(name) != nil {
+		return fmt.Errorf("room already exists")
+	}
+	room := &Room{Name: name, Owner: owner, Visibility: visibility, CreatedAt: time.Now(), CreatedBy: owner}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		room.PasswordHash = string(hash)
+	}
+	r.rooms = append(r.rooms, room)
+	return r.saveInternal()
+}
+
+func (r *Rooms) Remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, room := range r.rooms {
+		if room.Name == name {
+			r.rooms = append(r.rooms[:i], r.rooms[i+1:]...)
+			return r.saveInternal()
+		}
+	}
+	return fmt.Errorf("room does not exist")
+}
+
+// Update applies change to room and saves it, returning the new version.
+// Nothing is saved if change returns an error.
+func (r *Rooms) Update(name string, change func(room *Room) error) (Room, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	room := r.getInternal(name)
+	if room == nil {
+		return Room{}, fmt.Errorf("room does not exist")
+	}
+	updated := room.copy()
+	if err := change(&updated); err != nil {
+		return *room, err
+	}
+	*room = updated
+	return updated, r.saveInternal()
+}
+
+// Rename gives room old the name new.
+func (r *Rooms) Rename(old, new string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	room := r.getInternal(old)
+	if room == nil {
+		return fmt.Errorf("room does not exist")
+	}
+	if r.getInternal(new) != nil {
+		return fmt.Errorf("room already exists")
+	}
+	room.Name = new
+	return r.saveInternal()
+}
+
+// AddMember lets username into room. It reports whether they were added,
+// false meaning they already were a member.
+func (r *Rooms) AddMember(name, username string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	room := r.getInternal(name)
+	if room == nil {
+		return false, fmt.Errorf("room does not exist")
+	}
+	if room.IsMember(username) {
+		return false, nil
+	}
+	room.Members = append(room.Members, username)
+	return true, r.saveInternal()
+}
+
+// RemoveMember takes username out of room's members. It reports whether
+// they were a member.
+func (r *Rooms) RemoveMember(name, username string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	room := r.getInternal(name)
+	if room == nil {
+		return false, fmt.Errorf("room does not exist")
+	}
+	for i, m := range room.Members {
+		if m == username {
+			room.Members = append(room.Members[:i], room.Members[i+1:]...)
+			return true, r.saveInternal()
+		}
+	}
+	return false, nil
+}
+
+// SetRole gives username a role in room; an empty role takes it away.
+func (r *Rooms) SetRole(name, username, role string) error {
+	_, err := r.Update(name, func(room *Room) error {
+		if role == "" {
+			delete(room.Roles, username)
+			return nil
+		}
+		if room.Roles == nil {
+			room.Roles = make(map[string]string)
+		}
+		room.Roles[username] = role
+		return nil
+	})
+	return err
+}
+
+// checkRoomName tells the client and returns false if name can't be used
+// for a room.
+func (c *Client) checkRoomName(name string) bool {
+	if len(name) > 20 {
+		c.sendSystemMessage("Room name too long.")
+		return false
+	}
+	if strings.ContainsAny(name, `/\`) {
+		c.sendSystemMessage("Room name cannot contain slashes.")
+		return false
+	}
+	if strings.ContainsRune(name, ',') || strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+		c.sendSystemMessage("Room name cannot contain commas or spaces.")
+		return false
+	}
+	return true
+}
+
+// canManageRoom reports whether the client may change room and who is in
+// it.
+func (c *Client) canManageRoom(room Room) bool {
+	return c.can(PermRoomManage, room.Name)
+}
+
+// handleRoomInvite lets a user into a room: /room invite <room> <user>
+func (c *Client) handleRoomInvite(args []string) {
+	if len(args) != 2 {
+		c.sendSystemMessage("Usage: /room invite <room> <user>")
+		return
+	}
+	room, ok := c.hub.rooms.Get(args[0])
+	if !ok || !c.hub.CanReadRoom(c.user, room.Name) {
+		c.sendSystemMessage("Room does not exist.")
+		return
+	}
+	if !c.canManageRoom(room) {
+		c.sendSystemMessage("Only the room owner or an admin can invite.")
+		return
+	}
+	target, ok := c.hub.store.FindUser(args[1])
+	if !ok {
+		c.sendSystemMessage("User not found.")
+		return
+	}
+
+	added, err := c.hub.rooms.AddMember(room.Name, target.Username)
+	if err != nil {
+		c.sendSystemMessage("Failed to invite: " + err.Error())
+		return
+	}
+	if !added {
+		c.sendSystemMessage(fmt.Sprintf("%s is already a member of %s.", target.Username, room.Name))
+		return
+	}
+	c.hub.notifyUser(target.Username, fmt.Sprintf("%s invited you to %s. Join with /room join %s", c.user.Username, room.Name, room.Name))
+	c.sendSystemMessage(fmt.Sprintf("Invited %s to %s.", target.Username, room.Name))
+	log.Printf("User %s invited %s to %s", c.user.Username, target.Username, room.Name)
+}
+
+// handleRoomKick takes a user out of a room's members and sends them back
+// to general: /room kick <room> <user>
+func (c *Client) handleRoomKick(args []string) {
+	if len(args) != 2 {
+		c.sendSystemMessage("Usage: /room kick <room> <user>")
+		return
+	}
+	room, ok := c.hub.rooms.Get(args[0])
+	if !ok || !c.hub.CanReadRoom(c.user, room.Name) {
+		c.sendSystemMessage("Room does not exist.")
+		return
+	}
+	if !c.can(PermKick, room.Name) {
+		c.sendSystemMessage("Only the room owner, a moderator or an admin can kick.")
+		return
+	}
+	if room.Name == "general" {
+		c.sendSystemMessage("Cannot kick from the general room.")
+		return
+	}
+	target, ok := c.hub.store.GetUser(args[1])
+	if !ok {
+		c.sendSystemMessage("User not found.")
+		return
+	}
+	if target.Username == room.Owner {
+		c.sendSystemMessage("Cannot kick the room owner.")
+		return
+	}
+	mine := c.hub.roleIn(c.user, room.Name)
+	if globalRole(c.user) != RoleOwner && atLeast(c.hub.roleIn(target, room.Name), mine) {
+		c.sendSystemMessage(fmt.Sprintf("Only someone ranked above %s can do that.", mine))
+		return
+	}
+
+	removed, err := c.hub.rooms.RemoveMember(room.Name, target.Username)
+	if err != nil {
+		c.sendSystemMessage("Failed to kick: " + err.Error())
+		return
+	}
+	moved := c.hub.partRoomAll(room.Name, target.Username)
+	if !removed && moved == 0 {
+		c.sendSystemMessage(fmt.Sprintf("%s is not in %s.", target.Username, room.Name))
+		return
+	}
+	c.hub.notifyUser(target.Username, fmt.Sprintf("You were removed from %s.", room.Name))
+	c.sendSystemMessage(fmt.Sprintf("Removed %s from %s.", target.Username, room.Name))
+	log.Printf("User %s kicked %s from %s", c.user.Username, target.Username, room.Name)
+	c.recordAction(ModRoomKick, target.Username, room.Name, "", "")
+}
+
+// Limits on room details, in characters.
+const (
+	maxTopicLen       = 120
+	maxDescriptionLen = 500
+)
+
+// retentionInterval is how often old messages are deleted from rooms with
+// a retention period.
+const retentionInterval = time.Hour
+
+// roomPayload is what a client is told about the room it is in.
+func (h *Hub) roomPayload(name string) model.RoomPayload {
+	room, _ := h.rooms.Get(name)
+	return model.RoomPayload{Room: name, Topic: room.Topic, Archived: room.Archived}
+}
+
+// sendRoomUpdate tells the client the details of the room it is in.
+func (c *Client) sendRoomUpdate() {
+	c.sendEvent(model.EventRoomUpdate, c.hub.roomPayload(c.roomName()))
+}
+
+// handleRoomTopic shows or sets the topic of the current room:
+// /room topic [text|-]
+func (c *Client) handleRoomTopic(args []string) {
+	room, ok := c.hub.rooms.Get(c.roomName())
+	if !ok {
+		c.sendSystemMessage("Room does not exist.")
+		return
+	}
+	if len(args) == 0 {
+		if room.Topic == "" {
+			c.sendSystemMessage(fmt.Sprintf("No topic set for %s.", room.Name))
+		} else {
+			c.sendSystemMessage(fmt.Sprintf("Topic for %s: %s", room.Name, room.Topic))
+		}
+		return
+	}
+	if !c.canManageRoom(room) {
+		c.sendSystemMessage("Only the room owner or an admin can set the topic.")
+		return
+	}
+
+	topic := strings.Join(args, " ")
+	if topic == "-" {
+		topic = ""
+	}
+	if utf8.RuneCountInString(topic) > maxTopicLen {
+		c.sendSystemMessage(fmt.Sprintf("Topic too long (max %d characters).", maxTopicLen))
+		return
+	}
+	if _, err := c.hub.rooms.Update(room.Name, func(r *Room) error {
+		r.Topic = topic
+		return nil
+	}); err != nil {
+		c.sendSystemMessage("Failed to set topic: " + err.Error())
+		return
+	}
+
+	c.hub.broadcastEvent(room.Name, model.EventRoomUpdate, c.hub.roomPayload(room.Name))
+	if topic == "" {
+		c.hub.roomNotice(room.Name, fmt.Sprintf("%s cleared the topic.", c.user.Username))
+	} else {
+		c.hub.roomNotice(room.Name, fmt.Sprintf("%s set the topic: %s", c.user.Username, topic))
+	}
+	log.Printf("User %s set topic of %s: %s", c.user.Username, room.Name, topic)
+}
+
+// handleRoomInfo shows a room's details and settings: /room info [room]
+func (c *Client) handleRoomInfo(args []string) {
+	if len(args) > 1 {
+		c.sendSystemMessage("Usage: /room info [room]")
+		return
+	}
+	name := c.roomName()
+	if len(args) == 1 {
+		name = args[0]
+	}
+	room, ok := c.hub.rooms.Get(name)
+	if !ok || !c.hub.CanReadRoom(c.user, name) {
+		c.sendSystemMessage("Room does not exist.")
+		return
+	}
+
+	c.hub.mu.Lock()
+	online := c.hub.memberCountInternal(name, nil)
+	c.hub.mu.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Room: %s\n", room.Name))
+	if room.Topic != "" {
+		sb.WriteString(fmt.Sprintf("Topic: %s\n", room.Topic))
+	}
+	if room.Description != "" {
+		sb.WriteString(fmt.Sprintf("Description: %s\n", room.Description))
+	}
+	sb.WriteString(fmt.Sprintf("Visibility: %s", room.Visibility))
+	if room.PasswordHash != "" {
+		sb.WriteString(" (password)")
+	}
+	sb.WriteString("\n")
+	if room.Archived {
+		sb.WriteString("Archived: read-only\n")
+	}
+	if room.Owner != "" {
+		sb.WriteString(fmt.Sprintf("Owner: %s\n", room.Owner))
+	}
+	if !room.CreatedAt.IsZero() {
+		sb.WriteString(fmt.Sprintf("Created: %s by %s\n", room.CreatedAt.Format("2006-01-02 15:04"), room.CreatedBy))
+	}
+	if !room.Open() {
+		sb.WriteString(fmt.Sprintf("Members: %d\n", len(room.Members)))
+	}
+	sb.WriteString(fmt.Sprintf("Online: %d\n", online))
+	sb.WriteString(fmt.Sprintf("Max message length: %s\n", settingText(room.Settings.MaxMessageLength, "%d characters", "none")))
+	sb.WriteString(fmt.Sprintf("Slow mode: %s\n", settingText(room.Settings.SlowModeSeconds, "%ds", "off")))
+	sb.WriteString(fmt.Sprintf("History retention: %s\n", settingText(room.Settings.RetentionDays, "%d days", "forever")))
+	c.sendSystemMessage(sb.String())
+}
+
+// settingText formats a room setting, where zero means it is off.
+func settingText(value int, format, off string) string {
+	if value == 0 {
+		return off
+	}
+	return fmt.Sprintf(format, value)
+}
+
+// handleRoomSet changes a detail or setting of the current room:
+// /room set <setting> <value>
+func (c *Client) handleRoomSet(args []string) {
+	if len(args) < 2 {
+		c.sendSystemMessage("Usage: /room set <description|max_length|slow_mode|retention> <value>")
+		return
+	}
+	room, ok := c.hub.rooms.Get(c.roomName())
+	if !ok {
+		c.sendSystemMessage("Room does not exist.")
+		return
+	}
+	if !c.canManageRoom(room) {
+		c.sendSystemMessage("Only the room owner or an admin can change room settings.")
+		return
+	}
+
+	setting, value := args[0], strings.Join(args[1:], " ")
+	var change func(r *Room)
+	var shown string
+	if setting == "description" {
+		if value == "-" {
+			value = ""
+		}
+		if utf8.RuneCountInString(value) > maxDescriptionLen {
+			c.sendSystemMessage(fmt.Sprintf("Description too long (max %d characters).", maxDescriptionLen))
+			return
+		}
+		change = func(r *Room) { r.Description = value }
+		shown = value
+	} else {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			c.sendSystemMessage("Value must be a number, 0 to turn the setting off.")
+			return
+		}
+		switch setting {
+		case "max_length":
+			change = func(r *Room) { r.Settings.MaxMessageLength = n }
+			shown = settingText(n, "%d characters", "none")
+		case "slow_mode":
+			change = func(r *Room) { r.Settings.SlowModeSeconds = n }
+			shown = settingText(n, "%ds", "off")
+		case "retention":
+			change = func(r *Room) { r.Settings.RetentionDays = n }
+			shown = settingText(n, "%d days", "forever")
+		default:
+			c.sendSystemMessage("Unknown setting. Settings: description, max_length, slow_mode, retention")
+			return
+		}
+	}
+
+	updated, err := c.hub.rooms.Update(room.Name, func(r *Room) error {
+		change(r)
+		return nil
+	})
+	if err != nil {
+		c.sendSystemMessage("Failed to change setting: " + err.Error())
+		return
+	}
+	if setting == "retention" {
+		c.hub.applyRetention(updated)
+	}
+	if shown == "" {
+		shown = "(none)"
+	}
+	c.hub.roomNotice(room.Name, fmt.Sprintf("%s set %s of %s to %s", c.user.Username, setting, room.Name, shown))
+	log.Printf("User %s set %s of %s to %q", c.user.Username, setting, room.Name, value)
+}
+
+// checkMessageLength tells the client and returns false if content is too
+// long for room, or for a direct message if room is empty.
+func (c *Client) checkMessageLength(room, content string) bool {
+	limit, where := maxDirectMessageLength, "a direct message"
+	if room != "" {
+		r, ok := c.hub.rooms.Get(room)
+		if !ok {
+			return true
+		}
+		limit, where = r.Settings.MaxMessageLength, room
+	}
+	if limit == 0 || utf8.RuneCountInString(content) <= limit {
+		return true
+	}
+	c.sendSystemMessage(fmt.Sprintf("Message too long for %s (max %d characters).", where, limit))
+	return false
+}
+
+// slowModeKey is a user posting in a room.
+type slowModeKey struct {
+	room     string
+	username string
+}
+
+// checkSlowMode tells the client and returns false if they posted in room
+// too recently. Room owners and admins are exempt.
+func (c *Client) checkSlowMode(room string) bool {
+	r, ok := c.hub.rooms.Get(room)
+	if !ok || r.Settings.SlowModeSeconds == 0 || c.canManageRoom(r) {
+		return true
+	}
+
+	key := slowModeKey{room: room, username: c.user.Username}
+	now := time.Now()
+	c.hub.lastPostMu.Lock()
+	wait := c.hub.lastPost[key].Add(time.Duration(r.Settings.SlowModeSeconds) * time.Second).Sub(now)
+	if wait <= 0 {
+		c.hub.lastPost[key] = now
+	}
+	c.hub.lastPostMu.Unlock()
+
+	if wait > 0 {
+		c.sendEvent(model.EventRateLimited, model.RateLimitPayload{
+			Kind:       "slow_mode",
+			RetryAfter: retrySeconds(wait),
+			Message:    fmt.Sprintf("Slow mode is on in %s. Wait %ds before posting again.", room, retrySeconds(wait)),
+		})
+		return false
+	}
+	return true
+}
+
+// StartRetention deletes messages older than each room's retention
+// period, now and then every interval. It runs until the process exits.
+func (h *Hub) StartRetention(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, room := range h.rooms.List() {
+				h.applyRetention(room)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// applyRetention deletes the messages of room older than its retention
+// period, if it has one.
+func (h *Hub) applyRetention(room Room) {
+	if room.Settings.RetentionDays == 0 {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -room.Settings.RetentionDays)
+	pruned, err := h.store.PruneBefore(room.Name, cutoff)
+	if err != nil {
+		log.Printf("Failed to apply retention to %s: %v", room.Name, err)
+		return
+	}
+	if pruned > 0 {
+		log.Printf("Deleted %d messages older than %d days from %s", pruned, room.Settings.RetentionDays, room.Name)
+	}
+}
+
+// readersOf returns the logged-in connections that can read room.
+func (h *Hub) readersOf(room string) []*Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var readers []*Client
+	for client := range h.clients {
+		if client.user != nil && h.CanReadRoom(client.user, room) {
+			readers = append(readers, client)
+		}
+	}
+	return readers
+}
+
+// announceRoomChange tells readers about a change to a room, with an
+// event to update their room list and a notice to read. Readers that
+// disconnected since they were listed are skipped.
+func (h *Hub) announceRoomChange(readers []*Client, change model.RoomChangePayload, notice string) {
+	event, err := model.EncodeEvent(model.EventRoomChanged, change)
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	message, err := model.EncodeEvent(model.EventMessage, systemMessage(notice))
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, client := range readers {
+		if h.sendInternal(client, event) {
+			h.sendInternal(client, message)
+		}
+	}
+}
+
+// checkWritable tells the client and returns false if room is archived.
+func (c *Client) checkWritable(room string) bool {
+	if r, ok := c.hub.rooms.Get(room); ok && r.Archived {
+		c.sendSystemMessage(fmt.Sprintf("Room %s is archived and read-only.", room))
+		return false
+	}
+	return true
+}
+
+// handleRoomRemove deletes a room: /room remove <room>. Its history is set
+// aside rather than left for a new room of the same name to pick up, and
+// everyone who could read it is told.
+func (c *Client) handleRoomRemove(args []string) {
+	if !c.require(PermRoomRemove, "") {
+		return
+	}
+	if len(args) != 1 {
+		c.sendSystemMessage("Usage: /room remove <room_name>")
+		return
+	}
+	roomName := args[0]
+	if roomName == "general" {
+		c.sendSystemMessage("Cannot remove general room.")
+		return
+	}
+	if !c.hub.rooms.Exists(roomName) {
+		c.sendSystemMessage("Room does not exist.")
+		return
+	}
+
+	readers := c.hub.readersOf(roomName)
+	if err := c.hub.rooms.Remove(roomName); err != nil {
+		c.sendSystemMessage("Failed to remove room: " + err.Error())
+		return
+	}
+	if err := c.hub.store.DropRoom(roomName); err != nil {
+		log.Printf("Failed to set aside history of %s: %v", roomName, err)
+	}
+	if err := c.hub.markers.DropRoom(roomName); err != nil {
+		log.Printf("Failed to drop read markers of %s: %v", roomName, err)
+	}
+	if err := c.hub.filters.DropRoom(roomName); err != nil {
+		log.Printf("Failed to drop filter rules of %s: %v", roomName, err)
+	}
+
+	c.hub.partRoomAll(roomName, "")
+	c.hub.announceRoomChange(readers, model.RoomChangePayload{Room: roomName, Change: model.RoomRemoved, By: c.user.Username},
+		fmt.Sprintf("Room %s was removed by %s.", roomName, c.user.Username))
+	log.Printf("User %s removed room %s", c.user.Username, roomName)
+	c.recordAction(ModRoomRemove, roomName, "", "", "")
+}
+
+// handleRoomRename renames a room, carrying its history, read markers and
+// the connections in it over: /room rename <room> <new_name>
+func (c *Client) handleRoomRename(args []string) {
+	if len(args) != 2 {
+		c.sendSystemMessage("Usage: /room rename <room> <new_name>")
+		return
+	}
+	oldName, newName := args[0], args[1]
+	room, ok := c.hub.rooms.Get(oldName)
+	if !ok || !c.hub.CanReadRoom(c.user, oldName) {
+		c.sendSystemMessage("Room does not exist.")
+		return
+	}
+	if !c.canManageRoom(room) {
+		c.sendSystemMessage("Only the room owner or an admin can rename a room.")
+		return
+	}
+	if oldName == "general" {
+		c.sendSystemMessage("Cannot rename general room.")
+		return
+	}
+	if !c.checkRoomName(newName) {
+		return
+	}
+	if c.hub.rooms.Exists(newName) {
+		c.sendSystemMessage("Room already exists.")
+		return
+	}
+
+	readers := c.hub.readersOf(oldName)
+	if err := c.hub.store.RenameRoom(oldName, newName); err != nil {
+		c.sendSystemMessage("Failed to rename room: " + err.Error())
+		return
+	}
+	if err := c.hub.rooms.Rename(oldName, newName); err != nil {
+		// Put the history back where the room still expects it
+		if err := c.hub.store.RenameRoom(newName, oldName); err != nil {
+			log.Printf("Failed to move history of %s back: %v", oldName, err)
+		}
+		c.sendSystemMessage("Failed to rename room: " + err.Error())
+		return
+	}
+	if err := c.hub.markers.RenameRoom(oldName, newName); err != nil {
+		log.Printf("Failed to move read markers of %s: %v", oldName, err)
+	}
+	if err := c.hub.mentions.RenameRoom(oldName, newName); err != nil {
+		log.Printf("Failed to update mentions in %s: %v", oldName, err)
+	}
+	if err := c.hub.filters.RenameRoom(oldName, newName); err != nil {
+		log.Printf("Failed to move filter rules of %s: %v", oldName, err)
+	}
+
+	// Connections in the room stay in it under its new name
+	c.hub.mu.Lock()
+	for client := range c.hub.clients {
+		if client.subs[oldName] {
+			delete(client.subs, oldName)
+			client.subs[newName] = true
+		}
+		if client.Room == oldName {
+			client.Room = newName
+		}
+	}
+	c.hub.mu.Unlock()
+
+	c.hub.announceRoomChange(readers, model.RoomChangePayload{Room: oldName, Change: model.RoomRenamed, NewName: newName, By: c.user.Username},
+		fmt.Sprintf("Room %s was renamed to %s by %s.", oldName, newName, c.user.Username))
+	log.Printf("User %s renamed room %s to %s", c.user.Username, oldName, newName)
+	c.recordAction(ModRoomRename, oldName, "", "", "to "+newName)
+}
+
+// handleRoomArchive makes a room read-only, or restores it:
+// /room archive <room>, /room restore <room>
+func (c *Client) handleRoomArchive(args []string, archive bool) {
+	verb := "archive"
+	if !archive {
+		verb = "restore"
+	}
+	if len(args) != 1 {
+		c.sendSystemMessage(fmt.Sprintf("Usage: /room %s <room>", verb))
+		return
+	}
+	room, ok := c.hub.rooms.Get(args[0])
+	if !ok || !c.hub.CanReadRoom(c.user, room.Name) {
+		c.sendSystemMessage("Room does not exist.")
+		return
+	}
+	if !c.canManageRoom(room) {
+		c.sendSystemMessage(fmt.Sprintf("Only the room owner or an admin can %s a room.", verb))
+		return
+	}
+	if room.Name == "general" {
+		c.sendSystemMessage("Cannot archive general room.")
+		return
+	}
+	if room.Archived == archive {
+		if archive {
+			c.sendSystemMessage(fmt.Sprintf("Room %s is already archived.", room.Name))
+		} else {
+			c.sendSystemMessage(fmt.Sprintf("Room %s is not archived.", room.Name))
+		}
+		return
+	}
+
+	if _, err := c.hub.rooms.Update(room.Name, func(r *Room) error {
+		r.Archived = archive
+		return nil
+	}); err != nil {
+		c.sendSystemMessage(fmt.Sprintf("Failed to %s room: %v", verb, err))
+		return
+	}
+
+	c.hub.broadcastEvent(room.Name, model.EventRoomUpdate, c.hub.roomPayload(room.Name))
+	change := model.RoomChangePayload{Room: room.Name, Change: model.RoomArchived, By: c.user.Username}
+	notice := fmt.Sprintf("Room %s was archived by %s. Its history can still be read, but no new messages can be posted.", room.Name, c.user.Username)
+	if !archive {
+		change.Change = model.RoomRestored
+		notice = fmt.Sprintf("Room %s was restored by %s.", room.Name, c.user.Username)
+	}
+	c.hub.announceRoomChange(c.hub.readersOf(room.Name), change, notice)
+	log.Printf("User %s %sd room %s", c.user.Username, verb, room.Name)
+	if archive {
+		c.recordAction(ModRoomArchive, room.Name, "", "", "")
+	} else {
+		c.recordAction(ModRoomRestore, room.Name, "", "", "")
+	}
+}
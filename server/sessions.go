@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session is a credential handed to a client when it logs in. The client
+// keeps the token to call the REST API and to resume the login on its next
+// websocket connection. Only a hash of the token is stored on disk.
+type Session struct {
+	ID        string    `json:"id"` // Short handle for listing and revoking
+	TokenHash string    `json:"token_hash"`
+	Username  string    `json:"username"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// Token is only known right after Issue.
+	Token string `json:"-"`
+}
+
+func (s *Session) Expired(now time.Time) bool {
+	return !now.Before(s.Expires)
+}
+
+// Sessions keeps track of issued session tokens.
+type Sessions struct {
+	sessions map[string]*Session // Key: TokenHash
+	ttl      time.Duration
+	mu       sync.RWMutex
+	file     string
+}
+
+func NewSessions(file string, ttl time.Duration) *Sessions {
+	return &Sessions{
+		sessions: make(map[string]*Session),
+		ttl:      ttl,
+		file:     file,
+	}
+}
+
+func (s *Sessions) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Session
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, sess := range list {
+		if !sess.Expired(now) {
+			s.sessions[sess.TokenHash] = sess
+		}
+	}
+	return nil
+}
+
+// Helper to save sessions without locking (must be called with lock held)
+func (s *Sessions) saveInternal() error {
+	now := time.Now()
+	list := []*Session{}
+	for hash, sess := range s.sessions {
+		if sess.Expired(now) {
+			delete(s.sessions, hash)
+			continue
+		}
+		list = append(list, sess)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.file, data, 0600)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue creates a new session for username.
+func (s *Sessions) Issue(username string) (*Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+	hash := hashToken(token)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := &Session{
+		ID:        hash[:8],
+		TokenHash: hash,
+		Username:  username,
+		Created:   now,
+		Expires:   now.Add(s.ttl),
+		LastSeen:  now,
+	}
+	s.sessions[hash] = stored
+	if err := s.saveInternal(); err != nil {
+		delete(s.sessions, hash)
+		return nil, err
+	}
+
+	sess := *stored
+	sess.Token = token
+	return &sess, nil
+}
+
+// Lookup returns the live session for token and marks it as just used.
+func (s *Sessions) Lookup(token string) (*Session, bool) {
+	if token == "" {
+		return nil, false
+	}
+	hash := hashToken(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[hash]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if sess.Expired(now) {
+		delete(s.sessions, hash)
+		return nil, false
+	}
+	sess.LastSeen = now
+	return sess, true
+}
+
+// List returns the live sessions of username, or of everyone if username
+// is empty, oldest first.
+func (s *Sessions) List(username string) []Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var list []Session
+	for _, sess := range s.sessions {
+		if sess.Expired(now) || (username != "" && sess.Username != username) {
+			continue
+		}
+		list = append(list, *sess)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Revoke ends the session with the given ID. If username is not empty the
+// session must belong to that user. It returns the revoked session.
+func (s *Sessions) Revoke(id, username string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, sess := range s.sessions {
+		if sess.ID != id || (username != "" && sess.Username != username) {
+			continue
+		}
+		delete(s.sessions, hash)
+		s.saveInternal()
+		return sess, true
+	}
+	return nil, false
+}
+
+// RevokeUser ends every session of username and returns them.
+func (s *Sessions) RevokeUser(username string) []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var revoked []*Session
+	for hash, sess := range s.sessions {
+		if sess.Username == username {
+			delete(s.sessions, hash)
+			revoked = append(revoked, sess)
+		}
+	}
+	if len(revoked) > 0 {
+		s.saveInternal()
+	}
+	return revoked
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
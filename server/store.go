@@ -1,27 +1,93 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/puyokura/cmppchat/model"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// msgRef locates a message by conversation and sequence number. Room is a
+// room name or a direct message key from dmKey.
+type msgRef struct {
+	Room string
+	Seq  int64
+}
+
+// dmDir is the subdirectory of the message directory holding direct
+// message conversations.
+const dmDir = "dm"
+
+// removedDir is the subdirectory of the message directory where the
+// history of removed rooms is kept.
+const removedDir = "removed"
+
+// dmKey returns the key a direct message conversation between a and b is
+// stored under. It is the same whichever of the two is the sender, and
+// since room names can't contain "/" it never clashes with a room. A "+"
+// in a name is escaped too, so the separator can't be faked.
+func dmKey(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	escape := func(name string) string {
+		return strings.ReplaceAll(url.PathEscape(name), "+", "%2B")
+	}
+	return dmDir + "/" + escape(a) + "+" + escape(b)
+}
+
+// maxUsernameLen is the longest a new username can be, in characters.
+const maxUsernameLen = 20
+
+// validateUsername checks the name of a new account. Only letters, digits,
+// "_", "-" and "." are allowed, so a username reads the same in commands,
+// mentions and file names.
+func validateUsername(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > maxUsernameLen {
+		return fmt.Errorf("username must be 1 to %d characters", maxUsernameLen)
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_-.", r) {
+			return fmt.Errorf("username may only contain letters, digits, _, - and .")
+		}
+	}
+	return nil
+}
+
 type Store struct {
 	Users    map[string]*model.User     // Key: Username
 	Messages map[string][]model.Message // Key: Room
+	journals map[string]*journal        // Key: Room
+	index    map[string]msgRef          // Key: Message ID
+	replies  map[string][]string        // Key: Message ID, value: IDs of direct replies
 	mu       sync.RWMutex
 	userFile string
 	msgDir   string
+
+	// Held while rewriting a journal, so two rewrites of one journal never overlap
+	compactMu sync.Mutex
 }
 
 func NewStore(userFile, msgDir string) *Store {
 	return &Store{
 		Users:    make(map[string]*model.User),
 		Messages: make(map[string][]model.Message),
+		journals: make(map[string]*journal),
+		index:    make(map[string]msgRef),
+		replies:  make(map[string][]string),
 		userFile: userFile,
 		msgDir:   msgDir,
 	}
@@ -41,9 +107,23 @@ func (s *Store) Load() error {
 		if err := json.Unmarshal(data, &usersList); err != nil {
 			return err
 		}
+		migrated := false
 		for _, u := range usersList {
+			// Admins from before roles keep their rights
+			if u.IsAdmin {
+				if u.Role == "" {
+					u.Role = RoleAdmin
+				}
+				u.IsAdmin = false
+				migrated = true
+			}
 			s.Users[u.Username] = u
 		}
+		if migrated {
+			if err := s.saveUsersInternal(); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Ensure msgDir exists
@@ -57,23 +137,103 @@ func (s *Store) Load() error {
 		return err
 	}
 
+	// Migrate rooms still stored as a single JSON array
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), legacyExt) {
+			continue
+		}
+		roomName := strings.TrimSuffix(f.Name(), legacyExt)
+		journalPath := filepath.Join(s.msgDir, roomName+journalExt)
+		if _, err := os.Stat(journalPath); err == nil {
+			continue // Already migrated
+		}
+		if err := migrateLegacyRoom(filepath.Join(s.msgDir, f.Name()), journalPath); err != nil {
+			log.Printf("Failed to migrate room %s: %v", roomName, err)
+		}
+	}
+
+	files, err = os.ReadDir(s.msgDir)
+	if err != nil {
+		return err
+	}
+
+	// Direct message conversations live under dm/
+	dmFiles, err := os.ReadDir(filepath.Join(s.msgDir, dmDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range dmFiles {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), journalExt) {
+			files = append(files, dmEntry{f})
+		}
+	}
+
 	for _, f := range files {
-		if !f.IsDir() && len(f.Name()) > 5 && f.Name()[len(f.Name())-5:] == ".json" {
-			roomName := f.Name()[:len(f.Name())-5]
-			data, err := os.ReadFile(fmt.Sprintf("%s/%s", s.msgDir, f.Name()))
-			if err != nil {
-				continue // Skip bad files
+		if f.IsDir() || !strings.HasSuffix(f.Name(), journalExt) {
+			continue
+		}
+		roomName := strings.TrimSuffix(f.Name(), journalExt)
+		if _, ok := f.(dmEntry); ok {
+			roomName = dmDir + "/" + roomName
+		}
+		j, msgs, err := openJournal(filepath.Join(s.msgDir, roomName+journalExt))
+		if err != nil {
+			log.Printf("Failed to open journal for %s: %v", roomName, err)
+			continue // Skip bad files
+		}
+		// Messages written before IDs existed get them now, and the journal
+		// is rewritten so they stay stable across restarts.
+		if backfillMessageIDs(msgs) {
+			if err := j.rewrite(msgs); err != nil {
+				log.Printf("Failed to persist message IDs for %s: %v", roomName, err)
 			}
-			var msgs []model.Message
-			if err := json.Unmarshal(data, &msgs); err != nil {
-				continue
+		}
+		s.journals[roomName] = j
+		s.Messages[roomName] = msgs
+		for _, msg := range msgs {
+			s.index[msg.ID] = msgRef{Room: roomName, Seq: msg.Seq}
+			if msg.ReplyTo != "" {
+				s.replies[msg.ReplyTo] = append(s.replies[msg.ReplyTo], msg.ID)
 			}
-			s.Messages[roomName] = msgs
 		}
 	}
 	return nil
 }
 
+// dmEntry marks a directory entry found in the dm/ subdirectory.
+type dmEntry struct {
+	os.DirEntry
+}
+
+// backfillMessageIDs assigns an ID and sequence number to any message that
+// lacks one. It reports whether anything changed.
+func backfillMessageIDs(msgs []model.Message) bool {
+	changed := false
+	var last int64
+	for i := range msgs {
+		if msgs[i].Seq <= last {
+			msgs[i].Seq = last + 1
+			changed = true
+		}
+		if msgs[i].ID == "" {
+			msgs[i].ID = newMessageID()
+			changed = true
+		}
+		last = msgs[i].Seq
+	}
+	return changed
+}
+
+// newMessageID returns a random 12 character hex ID.
+func newMessageID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 func (s *Store) SaveUsers() error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -91,6 +251,9 @@ func (s *Store) SaveUsers() error {
 }
 
 func (s *Store) RegisterUser(username, password, ipid string) (*model.User, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -108,7 +271,6 @@ func (s *Store) RegisterUser(username, password, ipid string) (*model.User, erro
 		PasswordHash: string(hash),
 		IPID:         ipid,
 		Clans:        []string{},
-		IsAdmin:      false,
 	}
 
 	s.Users[username] = &newUser
@@ -134,6 +296,78 @@ func (s *Store) saveUsersInternal() error {
 	return os.WriteFile(s.userFile, data, 0644)
 }
 
+func (s *Store) GetUser(username string) (*model.User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.Users[username]
+	return user, ok
+}
+
+// SetRole gives username a server-wide role; an empty role makes them a
+// plain member again.
+func (s *Store) SetRole(username, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.Users[username]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+	user.Role = role
+	return s.saveUsersInternal()
+}
+
+// UsersWithRoles lists the users with a server-wide role, sorted by
+// username.
+func (s *Store) UsersWithRoles() []model.User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []model.User
+	for _, u := range s.Users {
+		if u.Role != "" {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// FindUser looks a user up by username, falling back to display name and
+// then to the username in any case.
+func (s *Store) FindUser(name string) (*model.User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if user, ok := s.Users[name]; ok {
+		return user, true
+	}
+	for _, u := range s.Users {
+		if u.DisplayName == name {
+			return u, true
+		}
+	}
+	for _, u := range s.Users {
+		if strings.EqualFold(u.Username, name) {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// FindUserByIPID looks a user up by IPID.
+func (s *Store) FindUserByIPID(ipid string) (*model.User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.Users {
+		if u.IPID == ipid {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
 func (s *Store) Authenticate(username, password string) (*model.User, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -150,42 +384,472 @@ func (s *Store) Authenticate(username, password string) (*model.User, error) {
 	return user, nil
 }
 
-func (s *Store) SaveRoomMessages(room string) error {
-	// Assumes lock is held by caller if needed, but here we use RLock for reading messages?
-	// No, this is internal helper usually.
-	// Let's make it public but careful about locks.
-	// Actually, AddMessage holds lock.
-	// We need an internal save.
+// AddMessage assigns msg an ID and the next sequence number in its room,
+// then appends it to the room journal. The stored message is returned.
+func (s *Store) AddMessage(msg model.Message) (model.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	msgs := s.Messages[room]
-	data, err := json.MarshalIndent(msgs, "", "  ")
-	if err != nil {
-		return err
+	room := msg.Room
+	if room == "" {
+		room = "general"
 	}
-	return os.WriteFile(fmt.Sprintf("%s/%s.json", s.msgDir, room), data, 0644)
+	msg.Room = room
+
+	return s.appendMessage(room, msg)
 }
 
-func (s *Store) AddMessage(msg model.Message) error {
+// AddDirectMessage stores a private message from msg.Sender to
+// msg.Recipient in their conversation, like AddMessage does for rooms.
+func (s *Store) AddDirectMessage(msg model.Message) (model.Message, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	room := msg.Room
-	if room == "" {
-		room = "general"
+	msg.Room = ""
+	return s.appendMessage(dmKey(msg.Sender, msg.Recipient), msg)
+}
+
+// appendMessage numbers msg and appends it to the conversation stored
+// under key. Must be called with s.mu held.
+func (s *Store) appendMessage(room string, msg model.Message) (model.Message, error) {
+	msg.ID = newMessageID()
+	for _, taken := s.index[msg.ID]; taken; _, taken = s.index[msg.ID] {
+		msg.ID = newMessageID()
+	}
+
+	j, err := s.journalFor(room)
+	if err != nil {
+		return msg, err
+	}
+	// Numbered by the journal, which remembers the last Seq even after
+	// retention pruned every message
+	msg.Seq = j.LastSeq() + 1
+	if err := j.Append(msg); err != nil {
+		return msg, err
 	}
 
 	s.Messages[room] = append(s.Messages[room], msg)
+	s.index[msg.ID] = msgRef{Room: room, Seq: msg.Seq}
+	if msg.ReplyTo != "" {
+		s.replies[msg.ReplyTo] = append(s.replies[msg.ReplyTo], msg.ID)
+	}
+	return s.withQuote(msg), nil
+}
+
+// quoteLen is how many characters of the parent a reply quotes.
+const quoteLen = 80
+
+// withQuote fills in the quote of a reply from its parent's current
+// version, so edits and deletions show up in quotes too. Quotes are never
+// stored. Must be called with lock held.
+func (s *Store) withQuote(msg model.Message) model.Message {
+	msg.Quote = nil
+	if msg.ReplyTo == "" {
+		return msg
+	}
+	parent, ok := s.lookupInternal(msg.ReplyTo)
+	if !ok {
+		return msg
+	}
+	quote := &model.Quote{ID: parent.ID, Sender: parent.Sender, Deleted: parent.Deleted}
+	if !parent.Deleted {
+		content := []rune(parent.Content)
+		if len(content) > quoteLen {
+			content = append(content[:quoteLen-1], '…')
+		}
+		quote.Content = string(content)
+	}
+	msg.Quote = quote
+	return msg
+}
+
+// lookupInternal finds a stored message by ID. Must be called with lock
+// held.
+func (s *Store) lookupInternal(id string) (model.Message, bool) {
+	ref, ok := s.index[id]
+	if !ok {
+		return model.Message{}, false
+	}
+	msgs := s.Messages[ref.Room]
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq >= ref.Seq })
+	if i == len(msgs) || msgs[i].ID != id {
+		return model.Message{}, false
+	}
+	return msgs[i], true
+}
+
+// UpdateMessage applies change to the stored message with the given ID and
+// persists the new version. If change returns an error nothing is saved.
+func (s *Store) UpdateMessage(id string, change func(msg *model.Message) error) (model.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref, ok := s.index[id]
+	if !ok {
+		return model.Message{}, fmt.Errorf("message not found")
+	}
+	msgs := s.Messages[ref.Room]
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq >= ref.Seq })
+	if i == len(msgs) || msgs[i].ID != id {
+		return model.Message{}, fmt.Errorf("message not found")
+	}
+
+	updated := msgs[i]
+	if err := change(&updated); err != nil {
+		return msgs[i], err
+	}
+
+	j, err := s.journalFor(ref.Room)
+	if err != nil {
+		return msgs[i], err
+	}
+	if err := j.Replace(updated); err != nil {
+		return msgs[i], err
+	}
+	msgs[i] = updated
+	return s.withQuote(updated), nil
+}
+
+// ToggleReaction adds username's emoji reaction to a message, or takes it
+// back if they already reacted with it.
+func (s *Store) ToggleReaction(id, emoji, username string) (model.Message, error) {
+	return s.UpdateMessage(id, func(msg *model.Message) error {
+		if msg.Deleted {
+			return fmt.Errorf("message was deleted")
+		}
+		// Copy so the stored version isn't changed if saving fails
+		reactions := make([]model.Reaction, 0, len(msg.Reactions)+1)
+		found := false
+		for _, r := range msg.Reactions {
+			if r.Emoji != emoji {
+				reactions = append(reactions, r)
+				continue
+			}
+			found = true
+			users := make([]string, 0, len(r.Users)+1)
+			reacted := false
+			for _, u := range r.Users {
+				if u == username {
+					reacted = true
+					continue
+				}
+				users = append(users, u)
+			}
+			if !reacted {
+				users = append(users, username)
+			}
+			if len(users) > 0 {
+				reactions = append(reactions, model.Reaction{Emoji: emoji, Users: users})
+			}
+		}
+		if !found {
+			if len(msg.Reactions) >= maxReactions {
+				return fmt.Errorf("too many different reactions on this message")
+			}
+			reactions = append(reactions, model.Reaction{Emoji: emoji, Users: []string{username}})
+		}
+		msg.Reactions = reactions
+		return nil
+	})
+}
+
+// ResolveMessageID expands a message ID or a unique prefix of one (at
+// least 4 characters) to the full ID.
+func (s *Store) ResolveMessageID(ref string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.index[ref]; ok {
+		return ref, nil
+	}
+	if len(ref) < 4 {
+		return "", fmt.Errorf("message not found")
+	}
+	found := ""
+	for id := range s.index {
+		if strings.HasPrefix(id, ref) {
+			if found != "" {
+				return "", fmt.Errorf("message ID %s is ambiguous, use more characters", ref)
+			}
+			found = id
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("message not found")
+	}
+	return found, nil
+}
+
+// GetMessage looks up a stored message by ID.
+func (s *Store) GetMessage(id string) (model.Message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msg, ok := s.lookupInternal(id)
+	if !ok {
+		return model.Message{}, false
+	}
+	return s.withQuote(msg), true
+}
+
+// LastMessage returns the newest message in room.
+func (s *Store) LastMessage(room string) (model.Message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msgs := s.Messages[room]
+	if len(msgs) == 0 {
+		return model.Message{}, false
+	}
+	return msgs[len(msgs)-1], true
+}
+
+// GetThread returns the whole thread a message belongs to: the message it
+// ultimately replies to and every reply below that, oldest first.
+func (s *Store) GetThread(id string) ([]model.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	root, ok := s.lookupInternal(id)
+	if !ok {
+		return nil, fmt.Errorf("message not found")
+	}
+	// Climb to the top; a missing parent ends the climb
+	for root.ReplyTo != "" {
+		parent, ok := s.lookupInternal(root.ReplyTo)
+		if !ok {
+			break
+		}
+		root = parent
+	}
+
+	thread := []model.Message{s.withQuote(root)}
+	queue := []string{root.ID}
+	for len(queue) > 0 {
+		children := s.replies[queue[0]]
+		queue = queue[1:]
+		for _, childID := range children {
+			if child, ok := s.lookupInternal(childID); ok {
+				thread = append(thread, s.withQuote(child))
+				queue = append(queue, childID)
+			}
+		}
+	}
+	sort.Slice(thread, func(i, j int) bool { return thread[i].Seq < thread[j].Seq })
+	return thread, nil
+}
+
+// journalFor returns the journal for room, creating it on first use.
+// Must be called with s.mu held.
+func (s *Store) journalFor(room string) (*journal, error) {
+	if j, ok := s.journals[room]; ok {
+		return j, nil
+	}
+	path := filepath.Join(s.msgDir, room+journalExt)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	j, _, err := openJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	s.journals[room] = j
+	return j, nil
+}
+
+// StartCompaction rewrites room journals that have built up stale lines,
+// checking every interval. It runs until the process exits.
+func (s *Store) StartCompaction(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.compactJournals()
+		}
+	}()
+}
+
+func (s *Store) compactJournals() {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.RLock()
+	pending := make(map[string]*journal)
+	for room, j := range s.journals {
+		pending[room] = j
+	}
+	s.mu.RUnlock()
 
-	return s.saveRoomMessagesInternal(room)
+	for room, j := range pending {
+		if !j.needsCompaction() {
+			continue
+		}
+		if err := j.compact(keepAllMessages); err != nil {
+			log.Printf("Failed to compact journal for %s: %v", room, err)
+			continue
+		}
+		log.Printf("Compacted journal for %s", room)
+	}
 }
 
-func (s *Store) saveRoomMessagesInternal(room string) error {
+// PruneBefore deletes the messages in room sent before cutoff, from memory
+// and from the room's journal. It returns how many were deleted.
+func (s *Store) PruneBefore(room string, cutoff time.Time) (int, error) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
 	msgs := s.Messages[room]
-	data, err := json.MarshalIndent(msgs, "", "  ")
+	kept := make([]model.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if !msg.Timestamp.Before(cutoff) {
+			kept = append(kept, msg)
+			continue
+		}
+		delete(s.index, msg.ID)
+		delete(s.replies, msg.ID)
+		if msg.ReplyTo != "" {
+			siblings := s.replies[msg.ReplyTo]
+			for i, id := range siblings {
+				if id == msg.ID {
+					s.replies[msg.ReplyTo] = append(siblings[:i:i], siblings[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	pruned := len(msgs) - len(kept)
+	if pruned == 0 {
+		s.mu.Unlock()
+		return 0, nil
+	}
+	s.Messages[room] = kept
+	j, err := s.journalFor(room)
+	s.mu.Unlock()
+	if err != nil {
+		return pruned, err
+	}
+
+	return pruned, j.compact(func(msgs []model.Message) []model.Message {
+		kept := msgs[:0]
+		for _, msg := range msgs {
+			if !msg.Timestamp.Before(cutoff) {
+				kept = append(kept, msg)
+			}
+		}
+		return kept
+	})
+}
+
+// RenameRoom moves the history of room old to room new. Messages keep
+// their IDs and carry the new room name from now on. The old journal is
+// set aside in messages/removed/, as for a removed room. If anything fails
+// the history stays under the old name.
+func (s *Store) RenameRoom(old, new string) error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.Messages[new]) > 0 {
+		return fmt.Errorf("history for %s already exists", new)
+	}
+	msgs := make([]model.Message, len(s.Messages[old]))
+	copy(msgs, s.Messages[old])
+	for i := range msgs {
+		msgs[i].Room = new
+	}
+
+	// Write the new journal before touching the old one
+	j, err := s.journalFor(new)
+	if err != nil {
+		return err
+	}
+	undo := func() {
+		j.Close()
+		delete(s.journals, new)
+		os.Remove(j.path)
+	}
+	if oldJournal, ok := s.journals[old]; ok {
+		j.keepSeq(oldJournal.LastSeq())
+	}
+	if err := j.rewrite(msgs); err != nil {
+		undo()
+		return err
+	}
+	if err := s.setAsideInternal(old); err != nil {
+		// Both journals would be loaded at the next start
+		undo()
+		return fmt.Errorf("set aside old journal: %w", err)
+	}
+
+	s.Messages[new] = msgs
+	delete(s.Messages, old)
+	for _, msg := range msgs {
+		s.index[msg.ID] = msgRef{Room: new, Seq: msg.Seq}
+	}
+	return nil
+}
+
+// DropRoom takes the history of a removed room out of the store. The
+// journal is moved to messages/removed/ rather than deleted, so an operator
+// can still recover it.
+func (s *Store) DropRoom(room string) error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, msg := range s.Messages[room] {
+		delete(s.index, msg.ID)
+		delete(s.replies, msg.ID)
+	}
+	delete(s.Messages, room)
+	return s.setAsideInternal(room)
+}
+
+// setAsideInternal closes the journal of room and moves it to
+// messages/removed/. If it can't be moved the journal is opened again.
+// Must be called with s.mu held.
+func (s *Store) setAsideInternal(room string) error {
+	path := filepath.Join(s.msgDir, room+journalExt)
+	if j, ok := s.journals[room]; ok {
+		j.Close()
+		delete(s.journals, room)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	dir := filepath.Join(s.msgDir, removedDir)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		target := filepath.Join(dir, fmt.Sprintf("%s-%d%s", room, time.Now().Unix(), journalExt))
+		err = os.Rename(path, target)
+	}
 	if err != nil {
+		if _, reopenErr := s.journalFor(room); reopenErr != nil {
+			log.Printf("Failed to reopen journal for %s: %v", room, reopenErr)
+		}
 		return err
 	}
-	return os.WriteFile(fmt.Sprintf("%s/%s.json", s.msgDir, room), data, 0644)
+	return nil
+}
+
+// keepAllMessages is the compaction policy: the latest version of every
+// message survives.
+func keepAllMessages(msgs []model.Message) []model.Message {
+	return msgs
+}
+
+// Close flushes and closes all room journals.
+func (s *Store) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for room, j := range s.journals {
+		if err := j.Close(); err != nil {
+			log.Printf("Failed to close journal for %s: %v", room, err)
+		}
+	}
 }
 
 func (s *Store) GetMessages(room string) []model.Message {
@@ -206,3 +870,94 @@ func (s *Store) GetMessages(room string) []model.Message {
 	copy(dest, src)
 	return dest
 }
+
+// HistoryCursor marks a position in room history, either by message ID or
+// by timestamp. The zero value means no bound.
+type HistoryCursor struct {
+	ID   string
+	Time time.Time
+}
+
+func (c HistoryCursor) IsZero() bool {
+	return c.ID == "" && c.Time.IsZero()
+}
+
+// GetMessagesPage returns up to limit messages from room, oldest first,
+// strictly between after and before. When before is set (or neither is)
+// the page ends right before it; with only after set the page starts
+// right after it.
+func (s *Store) GetMessagesPage(room string, before, after HistoryCursor, limit int) ([]model.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if room == "" {
+		room = "general"
+	}
+	return s.pageInternal(room, before, after, limit)
+}
+
+// GetDirectMessagesPage is GetMessagesPage for the direct messages between
+// users a and b.
+func (s *Store) GetDirectMessagesPage(a, b string, before, after HistoryCursor, limit int) ([]model.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pageInternal(dmKey(a, b), before, after, limit)
+}
+
+// Helper to page through a conversation (must be called with lock held)
+func (s *Store) pageInternal(room string, before, after HistoryCursor, limit int) ([]model.Message, error) {
+	msgs := s.Messages[room]
+
+	lo, hi := 0, len(msgs)
+	if !after.IsZero() {
+		i, err := s.cursorIndex(room, after, true)
+		if err != nil {
+			return nil, err
+		}
+		lo = i
+	}
+	if !before.IsZero() {
+		i, err := s.cursorIndex(room, before, false)
+		if err != nil {
+			return nil, err
+		}
+		hi = i
+	}
+	if lo > hi {
+		lo = hi
+	}
+
+	if hi-lo > limit {
+		if !after.IsZero() && before.IsZero() {
+			hi = lo + limit
+		} else {
+			lo = hi - limit
+		}
+	}
+
+	dest := make([]model.Message, hi-lo)
+	for i, msg := range msgs[lo:hi] {
+		dest[i] = s.withQuote(msg)
+	}
+	return dest, nil
+}
+
+// cursorIndex returns the index in room of the first message at the
+// cursor, or past it if past is set. Must be called with s.mu held.
+func (s *Store) cursorIndex(room string, cursor HistoryCursor, past bool) (int, error) {
+	msgs := s.Messages[room]
+	if cursor.ID != "" {
+		ref, ok := s.index[cursor.ID]
+		if !ok || ref.Room != room {
+			return 0, fmt.Errorf("unknown message id %q", cursor.ID)
+		}
+		if past {
+			return sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq > ref.Seq }), nil
+		}
+		return sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq >= ref.Seq }), nil
+	}
+	if past {
+		return sort.Search(len(msgs), func(i int) bool { return msgs[i].Timestamp.After(cursor.Time) }), nil
+	}
+	return sort.Search(len(msgs), func(i int) bool { return !msgs[i].Timestamp.Before(cursor.Time) }), nil
+}
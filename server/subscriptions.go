@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/puyokura/cmppchat/model"
+)
+
+// maxSubscriptions limits how many rooms one connection can be in at once.
+const maxSubscriptions = 32
+
+// subscriptionsInternal lists the rooms c is in, sorted. Must be called
+// with lock held.
+func (c *Client) subscriptionsInternal() []string {
+	rooms := make([]string, 0, len(c.subs))
+	for room := range c.subs {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// subscriptions lists the rooms c is in, sorted.
+func (c *Client) subscriptions() []string {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	return c.subscriptionsInternal()
+}
+
+// inRoom reports whether c is in room.
+func (c *Client) inRoom(room string) bool {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	return c.subs[room]
+}
+
+// joinRoom adds room to the connection's rooms if it isn't in it yet,
+// makes it the active room and tells the client to switch.
+func (c *Client) joinRoom(room string) {
+	c.sendEvent(model.EventRoomJoin, c.hub.roomPayload(room))
+
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	c.Room = room
+	if !c.subs[room] {
+		c.subs[room] = true
+		c.hub.enterInternal(c, room)
+	}
+}
+
+// setActiveRoom makes room the room chat text is posted to, if c is in
+// it. Clients name the room on screen with each message.
+func (c *Client) setActiveRoom(room string) bool {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	if !c.subs[room] {
+		return false
+	}
+	c.Room = room
+	return true
+}
+
+// partRoom takes the connection out of room. If it was the active room,
+// the client is moved to general or another room it is still in.
+func (c *Client) partRoom(room string) {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	c.hub.partRoomInternal(c, room)
+}
+
+// partRoomInternal is partRoom for callers holding the lock. It reports
+// whether c was in room.
+func (h *Hub) partRoomInternal(c *Client, room string) bool {
+	if !c.subs[room] {
+		return false
+	}
+	delete(c.subs, room)
+	h.leaveInternal(c, room)
+	h.sendEventInternal(c, model.EventRoomLeave, model.RoomPayload{Room: room})
+	if c.roomNameInternal() != room {
+		return true
+	}
+
+	next := "general"
+	if rooms := c.subscriptionsInternal(); len(rooms) > 0 && !c.subs["general"] {
+		next = rooms[0]
+	}
+	h.sendEventInternal(c, model.EventRoomJoin, h.roomPayload(next))
+	c.Room = next
+	if !c.subs[next] {
+		c.subs[next] = true
+		h.enterInternal(c, next)
+	}
+	return true
+}
+
+// partRoomAll takes the connections of username out of room, or every
+// connection if username is empty. It returns how many were in it.
+func (h *Hub) partRoomAll(room, username string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	parted := 0
+	for client := range h.clients {
+		if username != "" && (client.user == nil || client.user.Username != username) {
+			continue
+		}
+		if h.partRoomInternal(client, room) {
+			parted++
+		}
+	}
+	return parted
+}
+
+// handleRoomLeave leaves a room without leaving the others:
+// /room leave [room]
+func (c *Client) handleRoomLeave(args []string) {
+	if len(args) > 1 {
+		c.sendSystemMessage("Usage: /room leave [room]")
+		return
+	}
+	room := c.roomName()
+	if len(args) == 1 {
+		room = args[0]
+	}
+	if !c.inRoom(room) {
+		c.sendSystemMessage(fmt.Sprintf("You are not in %s.", room))
+		return
+	}
+	if len(c.subscriptions()) == 1 {
+		c.sendSystemMessage("You can't leave your only room.")
+		return
+	}
+	c.partRoom(room)
+	c.sendSystemMessage(fmt.Sprintf("Left room: %s", room))
+}
+
+// restoreRooms puts a reconnecting client back in the rooms it was in,
+// with active as the active room. Rooms it may no longer read are left.
+func (c *Client) restoreRooms(rooms []string, active string) {
+	if active != "" {
+		rooms = append(rooms, active)
+	}
+	var gone []string
+	wanted := make(map[string]bool)
+	c.hub.mu.Lock()
+	for _, room := range rooms {
+		if room == "" || wanted[room] {
+			continue
+		}
+		wanted[room] = true
+		if !c.hub.CanReadRoom(c.user, room) {
+			gone = append(gone, room)
+			continue
+		}
+		if len(c.subs) < maxSubscriptions {
+			c.subs[room] = true
+		}
+	}
+	moved := active != "" && !c.subs[active]
+	if !moved && active != "" {
+		c.Room = active
+		// New connections start in general; keep it only if asked for
+		if !wanted["general"] {
+			delete(c.subs, "general")
+		}
+	}
+	c.hub.mu.Unlock()
+
+	for _, room := range gone {
+		c.sendEvent(model.EventRoomLeave, model.RoomPayload{Room: room})
+		if room != active {
+			c.sendSystemMessage(fmt.Sprintf("Room %s is no longer available.", room))
+		}
+	}
+	if moved {
+		c.sendEvent(model.EventRoomJoin, c.hub.roomPayload(c.roomName()))
+		c.sendSystemMessage(fmt.Sprintf("Room %s is no longer available. Moved to %s.", active, c.roomName()))
+	}
+}
+
+// dropRoomsInternal takes c out of the rooms its user may not read, as
+// after logging out or in as someone else. General is always kept. Must be
+// called with lock held.
+func (h *Hub) dropRoomsInternal(c *Client) {
+	for _, room := range c.subscriptionsInternal() {
+		if room == "general" || h.CanReadRoom(c.user, room) {
+			continue
+		}
+		delete(c.subs, room)
+		h.sendEventInternal(c, model.EventRoomLeave, model.RoomPayload{Room: room})
+	}
+	if !c.subs[c.roomNameInternal()] {
+		c.subs["general"] = true
+		c.Room = "general"
+		h.sendEventInternal(c, model.EventRoomJoin, h.roomPayload(c.Room))
+	}
+}
+
+// dropRooms is dropRoomsInternal for callers not holding the lock.
+func (h *Hub) dropRooms(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dropRoomsInternal(c)
+}